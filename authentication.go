@@ -1,8 +1,8 @@
-package main
+package socks5
 
 import (
-	"bytes"
 	"errors"
+	"io"
 )
 
 type AuthType byte
@@ -23,17 +23,45 @@ const (
 )
 
 type passwordAuthentication struct {
-	user []byte
-	pass []byte
+	credentials CredentialStore
+	// attempts limits password guessing, nil allows every attempt
+	attempts authAttempts
+	// username is set after successful authentication
+	username string
 }
 
-func NewPasswordAuthentication(user, pass []byte) *passwordAuthentication {
+// authAttempts is notified of authentication attempts.
+type authAttempts interface {
+	// authLocked reports whether the attempt fails without checking
+	// the password
+	authLocked(user string) bool
+	authFailed(user string)
+	authSucceeded(user string)
+}
+
+func NewPasswordAuthentication(credentials CredentialStore) *passwordAuthentication {
 	return &passwordAuthentication{
-		user: user,
-		pass: pass,
+		credentials: credentials,
 	}
 }
 
+// Read reads VER, ULEN, UNAME, PLEN and PASSWD.
+func (state *passwordAuthentication) Read(r io.Reader) ([]byte, error) {
+	input, err := readBytes(r, nil, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ulen := int(input[1])
+	input, err = readBytes(r, input, ulen+1)
+	if err != nil {
+		return nil, err
+	}
+
+	plen := int(input[2+ulen])
+	return readBytes(r, input, plen)
+}
+
 func (state *passwordAuthentication) Receive(input []byte) ([]byte, error) {
 	err := state.validate(input)
 	if err != nil {
@@ -43,10 +71,21 @@ func (state *passwordAuthentication) Receive(input []byte) ([]byte, error) {
 	user := getUser(input)
 	pass := getPass(input)
 
-	if bytes.Compare(user, state.user) != 0 || bytes.Compare(pass, state.pass) != 0 {
+	if state.attempts != nil && state.attempts.authLocked(string(user)) {
+		return []byte{PASS_AUTH_VERSION, PASS_AUTH_FAIL}, errors.New("auth fail: locked out")
+	}
+
+	if state.credentials == nil || !state.credentials.Authenticate(user, pass) {
+		if state.attempts != nil {
+			state.attempts.authFailed(string(user))
+		}
 		return []byte{PASS_AUTH_VERSION, PASS_AUTH_FAIL}, errors.New("auth fail")
 	}
 
+	if state.attempts != nil {
+		state.attempts.authSucceeded(string(user))
+	}
+	state.username = string(user)
 	return []byte{PASS_AUTH_VERSION, PASS_AUTH_SUCCESS}, nil
 }
 
@@ -70,7 +109,7 @@ func (state passwordAuthentication) validate(input []byte) error {
 	}
 
 	ulen := int(input[1])
-	if ulen == 0 || ulen > len(input)-MIN_PASSAUTH_MESSAGE_LENGTH-1 {
+	if ulen == 0 || ulen > len(input)-MIN_PASSAUTH_MESSAGE_LENGTH+1 {
 		return errors.New("invalid username length")
 	}
 
@@ -1,9 +1,10 @@
-package main
+package socks5
 
 import (
 	"bytes"
 	"math/rand"
 	"testing"
+	"testing/iotest"
 )
 
 func TestGetUser(t *testing.T) {
@@ -36,6 +37,37 @@ func TestGetPass(t *testing.T) {
 	}
 }
 
+func Test_passwordAuthentication_Receive(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		want     []byte
+		username string
+		wantErr  bool
+	}{
+		{"success", []byte{0x01, 0x01, 'u', 0x01, 'p'}, []byte{PASS_AUTH_VERSION, PASS_AUTH_SUCCESS}, "u", false},
+		{"wrong password", []byte{0x01, 0x01, 'u', 0x01, 'x'}, []byte{PASS_AUTH_VERSION, PASS_AUTH_FAIL}, "", true},
+		{"unknown user", []byte{0x01, 0x01, 'x', 0x01, 'p'}, []byte{PASS_AUTH_VERSION, PASS_AUTH_FAIL}, "", true},
+		{"bad request", []byte{0x05, 0x01, 'u', 0x01, 'p'}, []byte{PASS_AUTH_VERSION, PASS_AUTH_BADREQUEST}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := NewPasswordAuthentication(Credentials{"u": "p"})
+			got, err := state.Receive(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Receive() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Receive() got = %v, want %v", got, tt.want)
+			}
+			if state.username != tt.username {
+				t.Errorf("Receive() username = %v, want %v", state.username, tt.username)
+			}
+		})
+	}
+}
+
 func generateRandomString(min, max int) string{
 	return generateString(generateIntInRange(min,max))
 }
@@ -51,4 +83,31 @@ func generateString(n int) string {
 		b[i] = letters[rand.Intn(len(letters))]
 	}
 	return string(b)
-}
\ No newline at end of file
+}
+
+func Test_passwordAuthentication_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"valid", []byte{0x01, 0x02, 'u', 's', 0x01, 'p'}, []byte{0x01, 0x02, 'u', 's', 0x01, 'p'}, false},
+		{"pipelined", []byte{0x01, 0x01, 'u', 0x01, 'p', PROTOCOL_VERSION}, []byte{0x01, 0x01, 'u', 0x01, 'p'}, false},
+		{"truncated username", []byte{0x01, 0x05, 'u', 's'}, nil, true},
+		{"truncated password", []byte{0x01, 0x01, 'u', 0x03, 'p'}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &passwordAuthentication{}
+			got, err := state.Read(iotest.OneByteReader(bytes.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Read() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Lockout scopes of Metrics and logs.
+const (
+	LOCKOUT_CLIENT = "client"
+	LOCKOUT_USER   = "user"
+)
+
+// AuthProtection slows down password guessing. Zero values disable
+// the delay or the lockout.
+type AuthProtection struct {
+	// BaseDelay delays the reply to the first failed attempt, the delay
+	// is doubled with every next failure up to MaxDelay. Zero MaxDelay
+	// keeps BaseDelay constant
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxFailures within FailureWindow lock out the client IP or
+	// the username for Lockout, attempts of a locked out client or user
+	// fail without checking the password
+	MaxFailures   int
+	FailureWindow time.Duration
+	Lockout       time.Duration
+	// Trusted networks are never delayed or locked out,
+	// their failures are not counted
+	Trusted []*net.IPNet
+}
+
+// delay returns the delay after the n-th failure in a row.
+func (a AuthProtection) delay(n int) time.Duration {
+	delay := a.BaseDelay
+	for i := 1; i < n && delay < a.MaxDelay; i++ {
+		delay *= 2
+	}
+	if a.MaxDelay > 0 && delay > a.MaxDelay {
+		delay = a.MaxDelay
+	}
+	return delay
+}
+
+// AUTH_GUARD_MAX_RECORDS caps client IPs and usernames with recent
+// failures each, the oldest records are dropped above it.
+const AUTH_GUARD_MAX_RECORDS = 10000
+
+// AUTH_GUARD_PRUNE_INTERVAL is the least period of records cleanup.
+const AUTH_GUARD_PRUNE_INTERVAL = time.Minute
+
+// authFailures are recent failures of a client IP or a username.
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authGuard counts failed authentications of a server
+// for AuthProtection.
+type authGuard struct {
+	mu      sync.Mutex
+	clients map[string]*authFailures
+	users   map[string]*authFailures
+	pruned  time.Time
+}
+
+// locked reports whether the client IP or the user is locked out.
+func (g *authGuard) locked(client string, user string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.clients[client]; ok && now.Before(f.lockedUntil) {
+		return true
+	}
+	if f, ok := g.users[user]; ok && now.Before(f.lockedUntil) {
+		return true
+	}
+	return false
+}
+
+// failed counts the failure of the client IP and the user. It returns
+// the delay of the reply and scopes which are locked out by this failure.
+func (g *authGuard) failed(client string, user string, cfg AuthProtection, now time.Time) (time.Duration, []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.clients == nil {
+		g.clients = make(map[string]*authFailures)
+		g.users = make(map[string]*authFailures)
+	}
+	g.prune(cfg, now)
+
+	var lockouts []string
+	count := 0
+	scopes := []struct {
+		scope    string
+		key      string
+		failures map[string]*authFailures
+	}{
+		{LOCKOUT_CLIENT, client, g.clients},
+		{LOCKOUT_USER, user, g.users},
+	}
+	for _, s := range scopes {
+		f, ok := s.failures[s.key]
+		if !ok {
+			if len(s.failures) >= AUTH_GUARD_MAX_RECORDS {
+				evictOldest(s.failures, now)
+			}
+			f = &authFailures{}
+			s.failures[s.key] = f
+		}
+		if cfg.FailureWindow > 0 && now.Sub(f.last) > cfg.FailureWindow {
+			f.count = 0
+		}
+		f.count++
+		f.last = now
+		if f.count > count {
+			count = f.count
+		}
+		if cfg.MaxFailures > 0 && cfg.Lockout > 0 && f.count >= cfg.MaxFailures {
+			f.lockedUntil = now.Add(cfg.Lockout)
+			f.count = 0
+			lockouts = append(lockouts, s.scope)
+		}
+	}
+	return cfg.delay(count), lockouts
+}
+
+// succeeded forgets failures of the client IP and the user.
+func (g *authGuard) succeeded(client string, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.clients, client)
+	delete(g.users, user)
+}
+
+// prune removes records with expired lockouts and records without
+// lockouts and failures within FailureWindow, at most once
+// per AUTH_GUARD_PRUNE_INTERVAL.
+func (g *authGuard) prune(cfg AuthProtection, now time.Time) {
+	if now.Sub(g.pruned) < AUTH_GUARD_PRUNE_INTERVAL {
+		return
+	}
+	g.pruned = now
+	for _, failures := range []map[string]*authFailures{g.clients, g.users} {
+		for key, f := range failures {
+			if now.Before(f.lockedUntil) {
+				continue
+			}
+			lockoutOver := !f.lockedUntil.IsZero()
+			windowOver := cfg.FailureWindow > 0 && now.Sub(f.last) > cfg.FailureWindow
+			if lockoutOver || windowOver {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// evictOldest removes the record with the oldest failure, records
+// which are locked out now are kept if there are others.
+func evictOldest(failures map[string]*authFailures, now time.Time) {
+	oldest, oldestLocked := "", ""
+	for key, f := range failures {
+		if now.Before(f.lockedUntil) {
+			if oldestLocked == "" || f.last.Before(failures[oldestLocked].last) {
+				oldestLocked = key
+			}
+		} else if oldest == "" || f.last.Before(failures[oldest].last) {
+			oldest = key
+		}
+	}
+	if oldest == "" {
+		oldest = oldestLocked
+	}
+	delete(failures, oldest)
+}
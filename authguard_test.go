@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthProtection_delay(t *testing.T) {
+	cfg := AuthProtection{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+	for _, tt := range tests {
+		if got := cfg.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) got = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+	if got := (AuthProtection{BaseDelay: time.Second}).delay(10); got != time.Second {
+		t.Errorf("delay() without MaxDelay got = %v", got)
+	}
+}
+
+func Test_authGuard(t *testing.T) {
+	cfg := AuthProtection{MaxFailures: 3, FailureWindow: time.Minute, Lockout: 5 * time.Minute}
+	now := time.Now()
+	guard := &authGuard{}
+
+	guard.failed("10.0.0.1", "alice", cfg, now)
+	guard.failed("10.0.0.2", "alice", cfg, now)
+	if guard.locked("10.0.0.1", "bob", now) {
+		t.Error("client locked out before MaxFailures")
+	}
+	_, lockouts := guard.failed("10.0.0.3", "alice", cfg, now)
+	if len(lockouts) != 1 || lockouts[0] != LOCKOUT_USER {
+		t.Errorf("lockouts got = %v, want %v", lockouts, []string{LOCKOUT_USER})
+	}
+	if !guard.locked("10.0.0.4", "alice", now) || guard.locked("10.0.0.4", "bob", now) {
+		t.Error("user is not locked out")
+	}
+	if guard.locked("10.0.0.4", "alice", now.Add(cfg.Lockout)) {
+		t.Error("lockout is not over")
+	}
+
+	// failures out of the window are forgotten
+	guard.failed("10.0.0.5", "bob", cfg, now)
+	guard.failed("10.0.0.5", "bob", cfg, now)
+	if _, lockouts := guard.failed("10.0.0.5", "bob", cfg, now.Add(2*time.Minute)); len(lockouts) != 0 {
+		t.Errorf("lockouts after the window got = %v", lockouts)
+	}
+
+	guard.succeeded("10.0.0.5", "bob")
+	guard.prune(cfg, now.Add(10*time.Minute))
+	if len(guard.clients) != 0 || len(guard.users) != 0 {
+		t.Errorf("records left after prune: %v %v", guard.clients, guard.users)
+	}
+}
+
+func Test_authGuard_prune(t *testing.T) {
+	cfg := AuthProtection{MaxFailures: 2, Lockout: 5 * time.Minute}
+	now := time.Now()
+	guard := &authGuard{}
+
+	guard.failed("10.0.0.1", "alice", cfg, now)
+	guard.failed("10.0.0.1", "alice", cfg, now)
+	guard.prune(cfg, now.Add(AUTH_GUARD_PRUNE_INTERVAL))
+	if len(guard.clients) != 1 || len(guard.users) != 1 {
+		t.Errorf("locked out records pruned: %v %v", guard.clients, guard.users)
+	}
+	guard.prune(cfg, now.Add(cfg.Lockout+2*AUTH_GUARD_PRUNE_INTERVAL))
+	if len(guard.clients) != 0 || len(guard.users) != 0 {
+		t.Errorf("records left after lockout without window: %v %v", guard.clients, guard.users)
+	}
+
+	for i := 0; i < AUTH_GUARD_MAX_RECORDS+10; i++ {
+		guard.failed("10.0.0.2", fmt.Sprintf("user%d", i), cfg, now.Add(time.Duration(i)))
+	}
+	if len(guard.users) != AUTH_GUARD_MAX_RECORDS {
+		t.Errorf("records got = %d, want %d", len(guard.users), AUTH_GUARD_MAX_RECORDS)
+	}
+	if _, ok := guard.users["user0"]; ok {
+		t.Error("the oldest record is not dropped")
+	}
+	if !guard.locked("10.0.0.2", "", now.Add(AUTH_GUARD_MAX_RECORDS)) {
+		t.Error("locked out client is dropped")
+	}
+}
+
+func TestServer_authProtection(t *testing.T) {
+	protection := AuthProtection{BaseDelay: 50 * time.Millisecond, MaxDelay: 100 * time.Millisecond, MaxFailures: 2, Lockout: time.Minute}
+	authenticate := func(server *Server, pass string) byte {
+		listener := listenServer(t, server)
+		defer listener.Close()
+		conn, status, _ := handshake(t, listener.Addr().String(), "alice", pass, nil)
+		conn.Close()
+		return status
+	}
+
+	server := NewServer(Config{Auth: PASS_AUTH, Credentials: Credentials{"alice": "secret"}, MTU: 1400, AuthProtection: protection}, nil)
+	defer server.Close()
+	started := time.Now()
+	if got := authenticate(server, "wrong"); got != PASS_AUTH_FAIL {
+		t.Errorf("wrong password reply got = %v", got)
+	}
+	if elapsed := time.Since(started); elapsed < protection.BaseDelay {
+		t.Errorf("failure reply time got = %v, want at least %v", elapsed, protection.BaseDelay)
+	}
+	authenticate(server, "wrong")
+	if got := authenticate(server, "secret"); got != PASS_AUTH_FAIL {
+		t.Errorf("locked out reply got = %v, want %v", got, PASS_AUTH_FAIL)
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	protection.Trusted = []*net.IPNet{loopback}
+	trusted := NewServer(Config{Auth: PASS_AUTH, Credentials: Credentials{"alice": "secret"}, MTU: 1400, AuthProtection: protection}, nil)
+	defer trusted.Close()
+	authenticate(trusted, "wrong")
+	authenticate(trusted, "wrong")
+	if got := authenticate(trusted, "secret"); got != PASS_AUTH_SUCCESS {
+		t.Errorf("trusted client reply got = %v, want %v", got, PASS_AUTH_SUCCESS)
+	}
+}
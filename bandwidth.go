@@ -0,0 +1,241 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth scopes of Metrics and logs.
+const (
+	SCOPE_GLOBAL  = "global"
+	SCOPE_USER    = "user"
+	SCOPE_CLIENT  = "client"
+	SCOPE_SESSION = "session"
+)
+
+// RateLimit is a token bucket of relayed bytes.
+type RateLimit struct {
+	// Rate is bytes per second, zero is unlimited
+	Rate int64
+	// Burst is bytes relayed without waiting after idle time,
+	// Rate is used if it's zero
+	Burst int64
+}
+
+func (l RateLimit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// Bandwidth limits each relay direction separately,
+// upload is client to target.
+type Bandwidth struct {
+	Upload   RateLimit
+	Download RateLimit
+}
+
+func (b Bandwidth) limit(direction string) RateLimit {
+	if direction == DIRECTION_UPLOAD {
+		return b.Upload
+	}
+	return b.Download
+}
+
+// BandwidthLimits are applied together, a session relays at the rate
+// of the most restrictive one.
+type BandwidthLimits struct {
+	// Global is shared by all sessions
+	Global Bandwidth
+	// PerUser is shared by sessions of an authenticated user,
+	// Users overrides it for some users
+	PerUser Bandwidth
+	Users   map[string]Bandwidth
+	// PerClient is shared by sessions from a client IP
+	PerClient Bandwidth
+	// PerSession applies to each session
+	PerSession Bandwidth
+}
+
+// bucket is a token bucket, tokens go negative on reservation and
+// the caller waits until they are refilled.
+type bucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.burst()), last: time.Now()}
+}
+
+// setLimit changes the rate, the tokens are kept.
+func (b *bucket) setLimit(limit RateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+// reserve takes n tokens and returns time to wait before they are used.
+func (b *bucket) reserve(n int64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate <= 0 {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.limit.Rate) * float64(time.Second))
+}
+
+// allow takes n tokens if they are available.
+func (b *bucket) allow(n int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate <= 0 {
+		return true
+	}
+
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.limit.Rate)
+	if burst := float64(b.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// buckets holds buckets shared by sessions. A bucket is removed when
+// the last session using it is finished.
+type buckets struct {
+	mu     sync.Mutex
+	shared map[string]*sharedBucket
+}
+
+type sharedBucket struct {
+	*bucket
+	sessions int
+}
+
+// acquire returns the bucket of the key, limit of an existing bucket
+// is updated, so reloaded limits apply to it.
+func (bs *buckets) acquire(key string, limit RateLimit) *bucket {
+	if bs == nil {
+		return newBucket(limit)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.shared == nil {
+		bs.shared = make(map[string]*sharedBucket)
+	}
+	shared, ok := bs.shared[key]
+	if ok {
+		shared.setLimit(limit)
+	} else {
+		shared = &sharedBucket{bucket: newBucket(limit)}
+		bs.shared[key] = shared
+	}
+	shared.sessions++
+	return shared.bucket
+}
+
+func (bs *buckets) release(key string) {
+	if bs == nil {
+		return
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if shared, ok := bs.shared[key]; ok {
+		shared.sessions--
+		if shared.sessions <= 0 {
+			delete(bs.shared, key)
+		}
+	}
+}
+
+// throttle limits one relay direction of a session.
+type throttle struct {
+	direction string
+	scopes    []string
+	buckets   []*bucket
+	// keys of shared buckets to release
+	keys   []string
+	shared *buckets
+}
+
+// newThrottle acquires buckets of the limits which apply to the session,
+// it returns nil if the direction is unlimited.
+func newThrottle(limits BandwidthLimits, shared *buckets, direction string, user string, client net.Addr) *throttle {
+	t := &throttle{direction: direction, shared: shared}
+
+	perUser := limits.PerUser
+	if bandwidth, ok := limits.Users[user]; ok {
+		perUser = bandwidth
+	}
+	if limit := limits.Global.limit(direction); limit.Rate > 0 {
+		t.add(SCOPE_GLOBAL, SCOPE_GLOBAL+"/"+direction, limit)
+	}
+	if limit := perUser.limit(direction); limit.Rate > 0 && user != "" {
+		t.add(SCOPE_USER, SCOPE_USER+"/"+direction+"/"+user, limit)
+	}
+	if limit := limits.PerClient.limit(direction); limit.Rate > 0 {
+		if addr, ok := client.(*net.TCPAddr); ok {
+			t.add(SCOPE_CLIENT, SCOPE_CLIENT+"/"+direction+"/"+addr.IP.String(), limit)
+		}
+	}
+	if limit := limits.PerSession.limit(direction); limit.Rate > 0 {
+		t.scopes = append(t.scopes, SCOPE_SESSION)
+		t.buckets = append(t.buckets, newBucket(limit))
+	}
+
+	if len(t.buckets) == 0 {
+		return nil
+	}
+	return t
+}
+
+func (t *throttle) add(scope string, key string, limit RateLimit) {
+	t.scopes = append(t.scopes, scope)
+	t.buckets = append(t.buckets, t.shared.acquire(key, limit))
+	t.keys = append(t.keys, key)
+}
+
+// reserve takes n bytes from every bucket and returns the longest wait
+// with the scope of its bucket.
+func (t *throttle) reserve(n int64) (time.Duration, string) {
+	now := time.Now()
+	var delay time.Duration
+	scope := ""
+	for i, b := range t.buckets {
+		if d := b.reserve(n, now); d > delay {
+			delay, scope = d, t.scopes[i]
+		}
+	}
+	return delay, scope
+}
+
+// release returns shared buckets.
+func (t *throttle) release() {
+	if t == nil {
+		return
+	}
+	for _, key := range t.keys {
+		t.shared.release(key)
+	}
+}
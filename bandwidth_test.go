@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_bucket_reserve(t *testing.T) {
+	now := time.Now()
+	b := newBucket(RateLimit{Rate: 1000, Burst: 500})
+	b.last = now
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		n     int64
+		want  time.Duration
+	}{
+		{"burst", 0, 500, 0},
+		{"empty", 0, 100, 100 * time.Millisecond},
+		{"refilled", 600 * time.Millisecond, 500, 0},
+		{"refill is limited by burst", 10 * time.Second, 1000, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.after)
+			if got := b.reserve(tt.n, now); got != tt.want {
+				t.Errorf("reserve() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	unlimited := newBucket(RateLimit{})
+	if got := unlimited.reserve(1<<30, now); got != 0 {
+		t.Errorf("reserve() of unlimited bucket got = %v", got)
+	}
+}
+
+func Test_newThrottle(t *testing.T) {
+	limit := RateLimit{Rate: 1000}
+	limits := BandwidthLimits{
+		Global:     Bandwidth{Download: limit},
+		PerUser:    Bandwidth{Download: limit},
+		Users:      map[string]Bandwidth{"bob": {}},
+		PerClient:  Bandwidth{Download: limit},
+		PerSession: Bandwidth{Download: limit},
+	}
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	shared := &buckets{}
+
+	if got := newThrottle(limits, shared, DIRECTION_UPLOAD, "alice", client); got != nil {
+		t.Errorf("newThrottle() of unlimited direction got = %v", got.scopes)
+	}
+
+	alice := newThrottle(limits, shared, DIRECTION_DOWNLOAD, "alice", client)
+	if len(alice.scopes) != 4 {
+		t.Errorf("newThrottle() scopes got = %v", alice.scopes)
+	}
+	bob := newThrottle(limits, shared, DIRECTION_DOWNLOAD, "bob", client)
+	if len(bob.scopes) != 3 {
+		t.Errorf("newThrottle() of user without limit scopes got = %v", bob.scopes)
+	}
+	if alice.buckets[0] != bob.buckets[0] || alice.buckets[2] != bob.buckets[1] {
+		t.Error("global and client buckets are not shared")
+	}
+
+	alice.release()
+	bob.release()
+	if len(shared.shared) != 0 {
+		t.Errorf("released buckets left = %v", len(shared.shared))
+	}
+}
+
+func Test_proxy_bandwidth(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	const size = 60 * 1024
+	limit := RateLimit{Rate: 100 * 1024, Burst: 10 * 1024}
+	cfg := Config{MTU: 1400, Bandwidth: BandwidthLimits{PerSession: Bandwidth{Download: limit}}}
+	client := connectThroughProxy(t, cfg, echo)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	started := time.Now()
+	go client.Write(make([]byte, size))
+	if _, err := io.ReadFull(client, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	// burst is sent at once, the rest at the rate
+	want := time.Duration(size-limit.Burst) * time.Second / time.Duration(limit.Rate)
+	if elapsed := time.Since(started); elapsed < want*8/10 {
+		t.Errorf("relay time got = %v, want at least %v", elapsed, want)
+	}
+}
@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"time"
+)
+
+const BIND_ACCEPT_TIMEOUT = 2 * time.Minute
+
+// bind waits for the inbound connection of one BIND request.
+type bind struct {
+	listener *net.TCPListener
+	expected net.IP
+	timeout  time.Duration
+	log      *zap.Logger
+}
+
+// newBind opens a listener on the address the client reached us on.
+// expected is DST.ADDR of the request, only a connection from this
+// address is accepted. Unspecified address accepts any peer.
+// Zero timeout means BIND_ACCEPT_TIMEOUT.
+func newBind(ctrl net.Conn, expected *net.TCPAddr, timeout time.Duration, logger *zap.Logger) (*bind, error) {
+	local, ok := ctrl.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("unable to get local address of control connection")
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		timeout = BIND_ACCEPT_TIMEOUT
+	}
+
+	b := &bind{listener: listener, timeout: timeout, log: logger}
+	if expected.IP != nil && !expected.IP.IsUnspecified() {
+		b.expected = expected.IP
+	}
+	return b, nil
+}
+
+func (b *bind) Addr() *net.TCPAddr {
+	return b.listener.Addr().(*net.TCPAddr)
+}
+
+// Accept waits for the expected peer up to the timeout.
+// The listener is closed afterwards, so only one connection is accepted.
+func (b *bind) Accept() (*net.TCPConn, error) {
+	defer b.listener.Close()
+
+	err := b.listener.SetDeadline(time.Now().Add(b.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn, err := b.listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if b.expected == nil || b.expected.Equal(peer.IP) {
+			return conn, nil
+		}
+
+		b.log.Info(fmt.Sprintf("Rejected BIND connection from unexpected peer %v, expected %v", peer, b.expected))
+		conn.Close()
+	}
+}
+
+func (b *bind) Close() {
+	b.listener.Close()
+}
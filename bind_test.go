@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"go.uber.org/zap"
+	"net"
+	"testing"
+)
+
+func Test_bind_Accept(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctrlClient, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrlClient.Close()
+	ctrlServer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrlServer.Close()
+
+	tests := []struct {
+		name     string
+		expected *net.TCPAddr
+	}{
+		{"any peer", &net.TCPAddr{IP: net.IPv4zero}},
+		{"expected peer", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newBind(ctrlServer, tt.expected, 0, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peer, err := net.Dial("tcp", b.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			conn, err := b.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error = %v", err)
+			}
+			defer conn.Close()
+
+			if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+				t.Errorf("Accept() got peer %v, want %v", conn.RemoteAddr(), peer.LocalAddr())
+			}
+		})
+	}
+}
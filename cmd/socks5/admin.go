@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAdminAddress = "127.0.0.1:1090"
+
+// version is set on build: -ldflags "-X main.version=1.2.0"
+var version = "dev"
+
+type ymladmin struct {
+	Enabled bool
+	Address string
+	// Token is required in Authorization: Bearer header
+	Token string
+}
+
+func defaultAdmin() ymladmin {
+	return ymladmin{Address: defaultAdminAddress}
+}
+
+func validateAdmin(yml ymladmin) error {
+	if !yml.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(yml.Address); err != nil {
+		return invalid("admin.address", "expected host:port, got %q", yml.Address)
+	}
+	if yml.Token == "" {
+		return invalid("admin.token", "must not be empty when admin is enabled")
+	}
+	return nil
+}
+
+// adminAPI lists and closes sessions of the server and shows
+// the effective config. Config is replaced on reload.
+type adminAPI struct {
+	server *socks5.Server
+
+	mu  sync.Mutex
+	cfg ymlconfig
+}
+
+func newAdminAPI(server *socks5.Server, cfg config) *adminAPI {
+	return &adminAPI{server: server, cfg: cfg.yml}
+}
+
+func (a *adminAPI) setConfig(cfg config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg.yml
+}
+
+func (a *adminAPI) config() ymlconfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// sessionView is a session in responses of /sessions.
+type sessionView struct {
+	ID     string `json:"id"`
+	Client string `json:"client"`
+	User   string `json:"user"`
+	// Command and Destination are empty before the request
+	Command     string    `json:"command"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+	// Age is in seconds
+	Age      float64 `json:"age"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+}
+
+// ServeHTTP checks the token and serves:
+//
+//	GET    /sessions?client=IP&user=NAME  active sessions, filters are optional
+//	DELETE /sessions/ID                   close the session
+//	DELETE /sessions?client=IP&user=NAME  close matched sessions
+//	GET    /config                        effective config, passwords redacted
+//	GET    /version                       build version
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/sessions" && r.Method == http.MethodGet:
+		a.listSessions(w, r)
+	case path == "/sessions" && r.Method == http.MethodDelete:
+		a.closeSessions(w, r)
+	case strings.HasPrefix(path, "/sessions/") && r.Method == http.MethodDelete:
+		a.closeSession(w, strings.TrimPrefix(path, "/sessions/"))
+	case path == "/config" && r.Method == http.MethodGet:
+		a.showConfig(w)
+	case path == "/version" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]string{"version": version, "go": runtime.Version()})
+	case path == "/sessions" || strings.HasPrefix(path, "/sessions/") || path == "/config" || path == "/version":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	token := a.config().Admin.Token
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (a *adminAPI) listSessions(w http.ResponseWriter, r *http.Request) {
+	match := sessionFilter(r)
+	now := time.Now()
+	views := []sessionView{}
+	for _, session := range a.server.Sessions() {
+		if match(session) {
+			views = append(views, newSessionView(session, now))
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *adminAPI) closeSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client") == "" && query.Get("user") == "" {
+		http.Error(w, "client or user is required", http.StatusBadRequest)
+		return
+	}
+	closed := a.server.CloseSessions(sessionFilter(r))
+	writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+}
+
+func (a *adminAPI) closeSession(w http.ResponseWriter, id string) {
+	if !a.server.CloseSession(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+}
+
+func (a *adminAPI) showConfig(w http.ResponseWriter) {
+	var buf bytes.Buffer
+	if err := printConfig(&buf, a.config()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(buf.Bytes())
+}
+
+// sessionFilter matches sessions by client IP and user of the query,
+// empty parameters match any session.
+func sessionFilter(r *http.Request) func(socks5.Session) bool {
+	client := net.ParseIP(r.URL.Query().Get("client"))
+	user := r.URL.Query().Get("user")
+	clientGiven := r.URL.Query().Get("client") != ""
+
+	return func(session socks5.Session) bool {
+		if user != "" && session.User != user {
+			return false
+		}
+		if clientGiven {
+			addr, ok := session.Client.(*net.TCPAddr)
+			if !ok || client == nil || !addr.IP.Equal(client) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func newSessionView(session socks5.Session, now time.Time) sessionView {
+	view := sessionView{
+		ID:       session.ID,
+		Client:   session.Client.String(),
+		User:     session.User,
+		Started:  session.Started,
+		Age:      now.Sub(session.Started).Seconds(),
+		BytesIn:  session.BytesIn,
+		BytesOut: session.BytesOut,
+	}
+	if req := session.Request; req != nil {
+		host := req.Domain
+		if host == "" && req.IP != nil {
+			host = req.IP.String()
+		}
+		view.Command = req.CommandName()
+		view.Destination = net.JoinHostPort(host, strconv.Itoa(req.Port))
+	}
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// serveAdmin starts admin listener on address.
+func serveAdmin(address string, api *adminAPI, logger *zap.Logger) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: api}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("Admin listener error: %v", err))
+		}
+	}()
+
+	logger.Info(fmt.Sprintf("Serving admin API on %s", listener.Addr().String()))
+	return server, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/NeekUP/socks5"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_adminAPI(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := socks5.NewServer(socks5.Config{Auth: socks5.NO_AUTH, MTU: 1400}, nil)
+	defer server.Close()
+	go server.Serve(listener)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	addr := target.Addr().(*net.TCPAddr)
+	message := []byte{socks5.PROTOCOL_VERSION, 0x01, byte(socks5.NO_AUTH)}
+	message = append(message, socks5.PROTOCOL_VERSION, socks5.CMD_CONNECT, 0x00, socks5.ATYP_IPV4)
+	message = append(message, addr.IP.To4()...)
+	message = append(message, byte(addr.Port>>8), byte(addr.Port))
+	client.Write(message)
+	if _, err := io.ReadFull(client, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+
+	yml := defaultConfig()
+	yml.Pass = "secret"
+	yml.Admin = ymladmin{Enabled: true, Address: defaultAdminAddress, Token: "token"}
+	api := newAdminAPI(server, config{yml: yml})
+
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"no token", http.MethodGet, "/sessions", "", http.StatusUnauthorized, "unauthorized"},
+		{"wrong token", http.MethodGet, "/sessions", "guess", http.StatusUnauthorized, "unauthorized"},
+		{"sessions", http.MethodGet, "/sessions", "token", http.StatusOK, `"destination":"` + addr.String() + `"`},
+		{"sessions of user", http.MethodGet, "/sessions?user=alice", "token", http.StatusOK, "[]"},
+		{"config", http.MethodGet, "/config", "token", http.StatusOK, "token: <redacted>"},
+		{"version", http.MethodGet, "/version", "token", http.StatusOK, `"version":"dev"`},
+		{"close without filter", http.MethodDelete, "/sessions", "token", http.StatusBadRequest, "client or user is required"},
+		{"close unknown", http.MethodDelete, "/sessions/missing", "token", http.StatusNotFound, "session not found"},
+		{"method", http.MethodPost, "/sessions", "token", http.StatusMethodNotAllowed, ""},
+		{"unknown path", http.MethodGet, "/debug", "token", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.method, tt.target, tt.token)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status got = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body got = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Errorf("body shows password: %q", w.Body.String())
+			}
+		})
+	}
+
+	w := request(http.MethodDelete, "/sessions?client=127.0.0.1", "token")
+	var closed map[string]int
+	if err := json.NewDecoder(w.Body).Decode(&closed); err != nil || closed["closed"] != 1 {
+		t.Errorf("close by client got = %v, error %v", closed, err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after close error = %v, want %v", err, io.EOF)
+	}
+}
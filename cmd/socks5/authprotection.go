@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"time"
+)
+
+// ymlauthprotection slows down password guessing, zero values disable
+// the delay or the lockout.
+type ymlauthprotection struct {
+	BaseDelay     time.Duration `yaml:"base_delay"`
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	MaxFailures   int           `yaml:"max_failures"`
+	FailureWindow time.Duration `yaml:"failure_window"`
+	Lockout       time.Duration
+	// Trusted are CIDRs or IPs which are never delayed or locked out
+	Trusted []string `yaml:",omitempty"`
+}
+
+func defaultAuthProtection() ymlauthprotection {
+	return ymlauthprotection{
+		BaseDelay:     500 * time.Millisecond,
+		MaxDelay:      5 * time.Second,
+		MaxFailures:   10,
+		FailureWindow: 10 * time.Minute,
+		Lockout:       10 * time.Minute,
+	}
+}
+
+func parseAuthProtection(yml ymlauthprotection) (socks5.AuthProtection, error) {
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"auth_protection.base_delay", yml.BaseDelay},
+		{"auth_protection.max_delay", yml.MaxDelay},
+		{"auth_protection.failure_window", yml.FailureWindow},
+		{"auth_protection.lockout", yml.Lockout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return socks5.AuthProtection{}, invalid(d.key, "must not be negative, got %v", d.value)
+		}
+	}
+	if yml.MaxFailures < 0 {
+		return socks5.AuthProtection{}, invalid("auth_protection.max_failures", "must not be negative, got %d", yml.MaxFailures)
+	}
+
+	trusted, err := parseNetworks(yml.Trusted)
+	if err != nil {
+		return socks5.AuthProtection{}, invalid("auth_protection.trusted", "%v", err)
+	}
+	return socks5.AuthProtection{
+		BaseDelay:     yml.BaseDelay,
+		MaxDelay:      yml.MaxDelay,
+		MaxFailures:   yml.MaxFailures,
+		FailureWindow: yml.FailureWindow,
+		Lockout:       yml.Lockout,
+		Trusted:       trusted,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseAuthProtection(t *testing.T) {
+	trusted := defaultAuthProtection()
+	trusted.Trusted = []string{"10.0.0.0/8", "192.168.1.5"}
+	negative := defaultAuthProtection()
+	negative.Lockout = -time.Minute
+	invalidNetwork := defaultAuthProtection()
+	invalidNetwork.Trusted = []string{"office"}
+
+	tests := []struct {
+		name    string
+		yml     ymlauthprotection
+		want    socks5.AuthProtection
+		wantKey string
+	}{
+		{"default", defaultAuthProtection(), socks5.AuthProtection{
+			BaseDelay: 500 * time.Millisecond, MaxDelay: 5 * time.Second,
+			MaxFailures: 10, FailureWindow: 10 * time.Minute, Lockout: 10 * time.Minute,
+		}, ""},
+		{"trusted", trusted, socks5.AuthProtection{
+			BaseDelay: 500 * time.Millisecond, MaxDelay: 5 * time.Second,
+			MaxFailures: 10, FailureWindow: 10 * time.Minute, Lockout: 10 * time.Minute,
+			Trusted: []*net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+				{IP: net.IP{192, 168, 1, 5}, Mask: net.CIDRMask(32, 32)},
+			},
+		}, ""},
+		{"negative", negative, socks5.AuthProtection{}, "auth_protection.lockout"},
+		{"invalid network", invalidNetwork, socks5.AuthProtection{}, "auth_protection.trusted"},
+		{"negative failures", ymlauthprotection{MaxFailures: -1}, socks5.AuthProtection{}, "auth_protection.max_failures"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAuthProtection(tt.yml)
+			if tt.wantKey != "" {
+				if keyErr, ok := err.(*keyError); !ok || keyErr.key != tt.wantKey {
+					t.Errorf("parseAuthProtection() error = %v, want key %v", err, tt.wantKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAuthProtection() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
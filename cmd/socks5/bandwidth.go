@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ymlbandwidth struct {
+	Global     ymllimits
+	PerUser    ymllimits `yaml:"per_user"`
+	PerClient  ymllimits `yaml:"per_client"`
+	PerSession ymllimits `yaml:"per_session"`
+	// Users override per_user limits
+	Users map[string]ymllimits `yaml:",omitempty"`
+}
+
+// ymllimits are byte sizes per second: 512KB, 10MB, empty is unlimited.
+// Burst defaults to the rate.
+type ymllimits struct {
+	Upload        string `yaml:",omitempty"`
+	Download      string `yaml:",omitempty"`
+	UploadBurst   string `yaml:"upload_burst,omitempty"`
+	DownloadBurst string `yaml:"download_burst,omitempty"`
+}
+
+// byteUnits are binary multiples, 1KB is 1024 bytes.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseBandwidth(yml ymlbandwidth) (socks5.BandwidthLimits, error) {
+	var limits socks5.BandwidthLimits
+	scopes := []struct {
+		key    string
+		yml    ymllimits
+		target *socks5.Bandwidth
+	}{
+		{"bandwidth.global", yml.Global, &limits.Global},
+		{"bandwidth.per_user", yml.PerUser, &limits.PerUser},
+		{"bandwidth.per_client", yml.PerClient, &limits.PerClient},
+		{"bandwidth.per_session", yml.PerSession, &limits.PerSession},
+	}
+	for _, scope := range scopes {
+		bandwidth, err := parseLimits(scope.key, scope.yml)
+		if err != nil {
+			return socks5.BandwidthLimits{}, err
+		}
+		*scope.target = bandwidth
+	}
+
+	users := make([]string, 0, len(yml.Users))
+	for user := range yml.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		bandwidth, err := parseLimits("bandwidth.users."+user, yml.Users[user])
+		if err != nil {
+			return socks5.BandwidthLimits{}, err
+		}
+		if limits.Users == nil {
+			limits.Users = map[string]socks5.Bandwidth{}
+		}
+		limits.Users[user] = bandwidth
+	}
+	return limits, nil
+}
+
+func parseLimits(key string, yml ymllimits) (socks5.Bandwidth, error) {
+	var bandwidth socks5.Bandwidth
+	values := []struct {
+		key    string
+		value  string
+		target *int64
+	}{
+		{"upload", yml.Upload, &bandwidth.Upload.Rate},
+		{"download", yml.Download, &bandwidth.Download.Rate},
+		{"upload_burst", yml.UploadBurst, &bandwidth.Upload.Burst},
+		{"download_burst", yml.DownloadBurst, &bandwidth.Download.Burst},
+	}
+	for _, v := range values {
+		size, err := parseByteSize(v.value)
+		if err != nil {
+			return socks5.Bandwidth{}, invalid(key+"."+v.key, "%v", err)
+		}
+		*v.target = size
+	}
+	return bandwidth, nil
+}
+
+// parseByteSize parses a number of bytes with optional B, KB, MB or GB
+// suffix, empty size is 0.
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected bytes with optional KB, MB or GB suffix", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q, too large", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"reflect"
+	"testing"
+)
+
+func Test_parseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1500", 1500, false},
+		{"512B", 512, false},
+		{"64KB", 64 << 10, false},
+		{"10 mb", 10 << 20, false},
+		{"1GB", 1 << 30, false},
+		{"1.5MB", 0, true},
+		{"-1KB", 0, true},
+		{"10Mbit", 0, true},
+		{"8589934591GB", 8589934591 << 30, false},
+		{"8589934592GB", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseByteSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseByteSize() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseBandwidth(t *testing.T) {
+	yml := ymlbandwidth{
+		Global:  ymllimits{Download: "10MB", DownloadBurst: "1MB"},
+		PerUser: ymllimits{Upload: "256KB"},
+		Users:   map[string]ymllimits{"alice": {Download: "1MB"}},
+	}
+	want := socks5.BandwidthLimits{
+		Global:  socks5.Bandwidth{Download: socks5.RateLimit{Rate: 10 << 20, Burst: 1 << 20}},
+		PerUser: socks5.Bandwidth{Upload: socks5.RateLimit{Rate: 256 << 10}},
+		Users:   map[string]socks5.Bandwidth{"alice": {Download: socks5.RateLimit{Rate: 1 << 20}}},
+	}
+	got, err := parseBandwidth(yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBandwidth() got = %+v, want %+v", got, want)
+	}
+
+	yml.Users["bob"] = ymllimits{UploadBurst: "lots"}
+	_, err = parseBandwidth(yml)
+	if keyErr, ok := err.(*keyError); !ok || keyErr.key != "bandwidth.users.bob.upload_burst" {
+		t.Errorf("parseBandwidth() error = %v", err)
+	}
+}
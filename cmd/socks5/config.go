@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type ymlconfig struct {
+	Network  string
+	Address  string
+	Port     int
+	Auth     string
+	User     string
+	Pass     string
+	Users    []ymluser
+	Htpasswd string
+	MTU      int
+	SOCKS4   bool `yaml:"socks4"`
+	Ruleset  ymlruleset
+	Upstream ymlupstream
+
+	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
+	ConnectTimeout     time.Duration `yaml:"connect_timeout"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout"`
+	MaxSessionLifetime time.Duration `yaml:"max_session_lifetime"`
+	DrainTimeout       time.Duration `yaml:"drain_timeout"`
+	WatchInterval      time.Duration `yaml:"watch_interval"`
+	MetricsAddress     string        `yaml:"metrics_address"`
+	AccessLog          string        `yaml:"access_log"`
+	Log                ymllog
+	Admin              ymladmin
+	Bandwidth          ymlbandwidth
+	Limits             ymlconnlimits
+	Quotas             ymlquotas
+	AuthProtection     ymlauthprotection `yaml:"auth_protection"`
+}
+
+// config holds server settings and settings of the executable.
+type config struct {
+	Server socks5.Config
+	// DrainTimeout limits waiting for active sessions on shutdown,
+	// zero means no limit
+	DrainTimeout time.Duration
+	// WatchInterval is a period of config file checks,
+	// zero disables reload on file change
+	WatchInterval time.Duration
+	// MetricsAddress is host:port of Prometheus metrics listener,
+	// empty disables metrics
+	MetricsAddress string
+	// AccessLog is stdout, stderr or a file path of session records,
+	// empty disables them
+	AccessLog string
+	Log       ymllog
+	// Admin is the admin HTTP API, disabled by default
+	Admin ymladmin
+	// Quotas are settings of quota usage file,
+	// QuotaLimits are applied to socks5.Quotas
+	Quotas      ymlquotas
+	QuotaLimits socks5.QuotaLimits
+
+	yml         ymlconfig
+	credentials socks5.Credentials
+}
+
+type ymluser struct {
+	Name string
+	Pass string
+}
+
+func tryParseConfig(opts options) (config, bool) {
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		fmt.Println(err)
+		return config{}, false
+	}
+	return cfg, true
+}
+
+// loadConfig parses the config file, applies overrides of flags and
+// environment and validates the result. It's used on start and on reload.
+func loadConfig(opts options) (config, error) {
+	src := &configSource{filename: opts.configFile, overrides: opts.overrides}
+	ymlcfg := defaultConfig()
+
+	data, err := ioutil.ReadFile(opts.configFile)
+	if err == nil {
+		src.data = data
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.SetStrict(true)
+		err = decoder.Decode(&ymlcfg)
+		if err != nil && err != io.EOF {
+			return config{}, src.decodeError(err)
+		}
+	} else if !os.IsNotExist(err) || !opts.configOptional {
+		return config{}, fmt.Errorf("Unable to open config file %s: %s", opts.configFile, err.Error())
+	}
+
+	if err = applyOverrides(&ymlcfg, opts.overrides); err != nil {
+		return config{}, err
+	}
+	if err = validateConfig(ymlcfg); err != nil {
+		return config{}, src.wrap(err)
+	}
+
+	auth := socks5.NO_AUTH
+	var credentials socks5.Credentials
+	if strings.ToUpper(ymlcfg.Auth) == "PASS" {
+		auth = socks5.PASS_AUTH
+		credentials, err = loadCredentials(ymlcfg)
+		if err != nil {
+			return config{}, src.wrap(err)
+		}
+		if len(credentials) == 0 {
+			return config{}, src.wrap(invalid("auth", "PASS requires user and pass, users or htpasswd"))
+		}
+	}
+
+	rules, err := parseRuleSet(ymlcfg.Ruleset)
+	if err != nil {
+		return config{}, src.wrap(&keyError{key: "ruleset", err: err})
+	}
+
+	router, err := parseRouter(ymlcfg.Upstream)
+	if err != nil {
+		return config{}, src.wrap(&keyError{key: "upstream", err: err})
+	}
+
+	bandwidth, err := parseBandwidth(ymlcfg.Bandwidth)
+	if err != nil {
+		return config{}, src.wrap(err)
+	}
+
+	quotaLimits, err := parseQuotas(ymlcfg.Quotas)
+	if err != nil {
+		return config{}, src.wrap(err)
+	}
+
+	authProtection, err := parseAuthProtection(ymlcfg.AuthProtection)
+	if err != nil {
+		return config{}, src.wrap(err)
+	}
+
+	cfg := socks5.Config{
+		Network: ymlcfg.Network,
+		Address: ymlcfg.Address,
+		Port:    ymlcfg.Port,
+		Auth:    auth,
+		MTU:     ymlcfg.MTU,
+		SOCKS4:  ymlcfg.SOCKS4,
+		Router:  router,
+		Rules:   rules,
+
+		HandshakeTimeout:   ymlcfg.HandshakeTimeout,
+		ConnectTimeout:     ymlcfg.ConnectTimeout,
+		IdleTimeout:        ymlcfg.IdleTimeout,
+		MaxSessionLifetime: ymlcfg.MaxSessionLifetime,
+
+		Bandwidth: bandwidth,
+		Limits:    connectionLimits(ymlcfg.Limits),
+
+		AuthProtection: authProtection,
+	}
+	if credentials != nil {
+		cfg.Credentials = credentials
+	}
+
+	return config{
+		Server:         cfg,
+		DrainTimeout:   ymlcfg.DrainTimeout,
+		WatchInterval:  ymlcfg.WatchInterval,
+		MetricsAddress: ymlcfg.MetricsAddress,
+		AccessLog:      ymlcfg.AccessLog,
+		Log:            ymlcfg.Log,
+		Admin:          ymlcfg.Admin,
+		Quotas:         ymlcfg.Quotas,
+		QuotaLimits:    quotaLimits,
+		yml:            ymlcfg,
+		credentials:    credentials,
+	}, nil
+}
+
+// loadCredentials merges users of htpasswd file, users list and
+// single user/pass pair.
+func loadCredentials(ymlcfg ymlconfig) (socks5.Credentials, error) {
+	credentials := socks5.Credentials{}
+	if ymlcfg.Htpasswd != "" {
+		var err error
+		credentials, err = socks5.LoadHtpasswd(ymlcfg.Htpasswd)
+		if err != nil {
+			return nil, &keyError{key: "htpasswd", err: err}
+		}
+	}
+
+	if ymlcfg.User != "" || ymlcfg.Pass != "" {
+		if ymlcfg.User == "" || ymlcfg.Pass == "" {
+			return nil, invalid("user", "user or password not defined")
+		}
+	}
+
+	users := ymlcfg.Users
+	if ymlcfg.User != "" {
+		users = append(users, ymluser{Name: ymlcfg.User, Pass: ymlcfg.Pass})
+	}
+
+	for _, user := range users {
+		if user.Name == "" || user.Pass == "" {
+			return nil, invalid("users", "user or password not defined")
+		}
+		if _, ok := credentials[user.Name]; ok {
+			return nil, invalid("users", "duplicate user %s", user.Name)
+		}
+		credentials[user.Name] = user.Pass
+	}
+
+	if err := credentials.Validate(); err != nil {
+		return nil, &keyError{key: "users", err: err}
+	}
+	return credentials, nil
+}
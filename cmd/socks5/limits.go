@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+)
+
+// ymlconnlimits are connection limits, zero is unlimited.
+type ymlconnlimits struct {
+	MaxSessions          int `yaml:"max_sessions"`
+	MaxSessionsPerClient int `yaml:"max_sessions_per_client"`
+	MaxSessionsPerUser   int `yaml:"max_sessions_per_user"`
+	// AcceptRate is new connections per second, AcceptBurst defaults to it
+	AcceptRate  int `yaml:"accept_rate"`
+	AcceptBurst int `yaml:"accept_burst"`
+}
+
+func validateConnLimits(yml ymlconnlimits) error {
+	values := []struct {
+		key   string
+		value int
+	}{
+		{"limits.max_sessions", yml.MaxSessions},
+		{"limits.max_sessions_per_client", yml.MaxSessionsPerClient},
+		{"limits.max_sessions_per_user", yml.MaxSessionsPerUser},
+		{"limits.accept_rate", yml.AcceptRate},
+		{"limits.accept_burst", yml.AcceptBurst},
+	}
+	for _, v := range values {
+		if v.value < 0 {
+			return invalid(v.key, "must not be negative, got %d", v.value)
+		}
+	}
+	return nil
+}
+
+func connectionLimits(yml ymlconnlimits) socks5.ConnectionLimits {
+	return socks5.ConnectionLimits{
+		MaxSessions:          yml.MaxSessions,
+		MaxSessionsPerClient: yml.MaxSessionsPerClient,
+		MaxSessionsPerUser:   yml.MaxSessionsPerUser,
+		AcceptRate:           socks5.RateLimit{Rate: int64(yml.AcceptRate), Burst: int64(yml.AcceptBurst)},
+	}
+}
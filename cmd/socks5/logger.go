@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"time"
+)
+
+const defaultLogFilename = "./socks5.log"
+
+// Log outputs.
+const (
+	LOG_FILE   = "file"
+	LOG_STDOUT = "stdout"
+	LOG_STDERR = "stderr"
+	LOG_SYSLOG = "syslog"
+)
+
+type ymllog struct {
+	Level    string
+	Output   string
+	File     string
+	Encoding string
+	// rotation of the file output
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"`
+	Compress   bool   `yaml:"compress"`
+	SyslogTag  string `yaml:"syslog_tag"`
+	Sampling   ymlsampling
+}
+
+// ymlsampling limits repeated messages per second: the first Initial ones
+// are logged, then every Thereafter-th. Zero Initial disables sampling.
+type ymlsampling struct {
+	Initial    int
+	Thereafter int
+}
+
+func defaultLog() ymllog {
+	return ymllog{
+		Level:      "info",
+		Output:     LOG_FILE,
+		File:       defaultLogFilename,
+		Encoding:   "json",
+		MaxSize:    100, // megabytes
+		MaxBackups: 3,
+		MaxAge:     28, // days
+		SyslogTag:  "socks5",
+		Sampling:   ymlsampling{Thereafter: 100},
+	}
+}
+
+func validateLog(yml ymllog) error {
+	if _, err := parseLevel(yml.Level); err != nil {
+		return invalid("log.level", "unknown level %q, expected debug, info, warn or error", yml.Level)
+	}
+	switch yml.Output {
+	case LOG_FILE:
+		if yml.File == "" {
+			return invalid("log.file", "must not be empty for file output")
+		}
+	case LOG_STDOUT, LOG_STDERR, LOG_SYSLOG:
+	default:
+		return invalid("log.output", "unknown output %q, expected file, stdout, stderr or syslog", yml.Output)
+	}
+	if yml.Encoding != "json" && yml.Encoding != "console" {
+		return invalid("log.encoding", "unknown encoding %q, expected json or console", yml.Encoding)
+	}
+
+	numbers := []struct {
+		key   string
+		value int
+	}{
+		{"log.max_size", yml.MaxSize},
+		{"log.max_backups", yml.MaxBackups},
+		{"log.max_age", yml.MaxAge},
+		{"log.sampling.initial", yml.Sampling.Initial},
+		{"log.sampling.thereafter", yml.Sampling.Thereafter},
+	}
+	for _, n := range numbers {
+		if n.value < 0 {
+			return invalid(n.key, "must not be negative, got %d", n.value)
+		}
+	}
+	// zap sampler divides by thereafter
+	if yml.Sampling.Initial > 0 && yml.Sampling.Thereafter < 1 {
+		return invalid("log.sampling.thereafter", "must be at least 1 with sampling, got %d", yml.Sampling.Thereafter)
+	}
+	return nil
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	var l zapcore.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// newLogger builds the diagnostic logger, its level can be changed
+// through level at runtime.
+func newLogger(yml ymllog, level zap.AtomicLevel) (*zap.Logger, error) {
+	var sink zapcore.WriteSyncer
+	switch yml.Output {
+	case LOG_STDOUT:
+		sink = zapcore.Lock(os.Stdout)
+	case LOG_STDERR:
+		sink = zapcore.Lock(os.Stderr)
+	case LOG_SYSLOG:
+		var err error
+		if sink, err = newSyslogSink(yml.SyslogTag); err != nil {
+			return nil, fmt.Errorf("syslog: %v", err)
+		}
+	default:
+		sink = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   yml.File,
+			MaxSize:    yml.MaxSize,
+			MaxBackups: yml.MaxBackups,
+			MaxAge:     yml.MaxAge,
+			Compress:   yml.Compress,
+		})
+	}
+
+	encoderConfig := zapcore.EncoderConfig{
+		MessageKey: "message",
+
+		LevelKey:    "level",
+		EncodeLevel: zapcore.CapitalLevelEncoder,
+
+		TimeKey:    "time",
+		EncodeTime: zapcore.ISO8601TimeEncoder,
+
+		CallerKey:    "caller",
+		EncodeCaller: zapcore.ShortCallerEncoder,
+
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	if yml.Output == LOG_SYSLOG {
+		// syslog adds its own timestamp
+		encoderConfig.TimeKey = ""
+	}
+
+	var encoder zapcore.Encoder
+	if yml.Encoding == "console" {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+
+	core := zapcore.NewCore(encoder, sink, level)
+	if yml.Sampling.Initial > 0 {
+		core = zapcore.NewSampler(core, time.Second, yml.Sampling.Initial, yml.Sampling.Thereafter)
+	}
+	return zap.New(core), nil
+}
+
+// newAccessLogger writes session records as JSON to stdout, stderr or
+// a rotated file. Duration is in seconds.
+func newAccessLogger(destination string) *zap.Logger {
+	var sink zapcore.WriteSyncer
+	switch destination {
+	case LOG_STDOUT:
+		sink = zapcore.Lock(os.Stdout)
+	case LOG_STDERR:
+		sink = zapcore.Lock(os.Stderr)
+	default:
+		sink = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   destination,
+			MaxSize:    100, // megabytes
+			MaxBackups: 3,
+			MaxAge:     28, // days
+		})
+	}
+
+	encoder := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		MessageKey: "message",
+
+		TimeKey:    "time",
+		EncodeTime: zapcore.ISO8601TimeEncoder,
+
+		EncodeDuration: zapcore.SecondsDurationEncoder,
+	})
+
+	return zap.New(zapcore.NewCore(encoder, sink, zapcore.InfoLevel))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_newLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yml := defaultLog()
+	yml.File = filepath.Join(dir, "socks5.log")
+	yml.Encoding = "console"
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	logger, err := newLogger(yml, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("hidden")
+	level.SetLevel(zap.DebugLevel)
+	logger.Debug("shown")
+	logger.Sync()
+
+	data, err := ioutil.ReadFile(yml.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hidden") || !strings.Contains(string(data), "DEBUG\tshown") {
+		t.Errorf("log got = %q", data)
+	}
+}
+
+func Test_newLogger_sampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yml := defaultLog()
+	yml.File = filepath.Join(dir, "socks5.log")
+	// thereafter keeps its default, like SOCKS5_LOG_SAMPLING_INITIAL alone
+	yml.Sampling.Initial = 2
+	if err := validateLog(yml); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := newLogger(yml, zap.NewAtomicLevelAt(zap.InfoLevel))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 105; i++ {
+		logger.Info("repeated")
+	}
+	logger.Sync()
+
+	data, err := ioutil.ReadFile(yml.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 initial, then the 100th of the rest
+	if got := strings.Count(string(data), "repeated"); got != 3 {
+		t.Errorf("logged messages got = %d, want 3", got)
+	}
+}
+
+func Test_validateLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(yml *ymllog)
+		wantErr bool
+	}{
+		{"default", func(yml *ymllog) {}, false},
+		{"stdout without file", func(yml *ymllog) { yml.Output, yml.File = LOG_STDOUT, "" }, false},
+		{"file without name", func(yml *ymllog) { yml.File = "" }, true},
+		{"unknown level", func(yml *ymllog) { yml.Level = "trace" }, true},
+		{"unknown encoding", func(yml *ymllog) { yml.Encoding = "xml" }, true},
+		{"negative sampling", func(yml *ymllog) { yml.Sampling.Initial = -1 }, true},
+		{"sampling", func(yml *ymllog) { yml.Sampling.Initial = 100 }, false},
+		{"sampling without thereafter", func(yml *ymllog) { yml.Sampling.Initial, yml.Sampling.Thereafter = 100, 0 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yml := defaultLog()
+			tt.change(&yml)
+			if err := validateLog(yml); (err != nil) != tt.wantErr {
+				t.Errorf("validateLog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
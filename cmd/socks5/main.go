@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const configFilename string = "socks5.yaml"
+
+// Exit statuses, supervisor can tell a clean drain from a forced one.
+const (
+	EXIT_OK           = 0
+	EXIT_ERROR        = 1
+	EXIT_DRAIN_FORCED = 2
+)
+
+const closeWaitTimeout = time.Second
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	opts, err := parseOptions(args, os.LookupEnv, os.Stderr)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_ERROR
+	}
+
+	var cfg config
+	var ok bool
+	if cfg, ok = tryParseConfig(opts); !ok {
+		return EXIT_ERROR
+	}
+
+	if opts.checkConfig {
+		if err := printConfig(os.Stdout, cfg.yml); err != nil {
+			fmt.Printf("Fail to print config: %v", err)
+			return EXIT_ERROR
+		}
+		return EXIT_OK
+	}
+
+	// level is validated already
+	initialLevel, _ := parseLevel(cfg.Log.Level)
+	level := zap.NewAtomicLevelAt(initialLevel)
+	logger, err := newLogger(cfg.Log, level)
+	if err != nil {
+		fmt.Printf("Unable to open log: %v\n", err)
+		return EXIT_ERROR
+	}
+	defer logger.Sync()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	reload := make(chan struct{}, 1)
+	if cfg.WatchInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go watchConfig(opts.configFile, cfg.WatchInterval, reload, done)
+	}
+
+	if cfg.Quotas.File != "" {
+		quotas, err := socks5.LoadQuotas(cfg.Quotas.File)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to load quotas: %v", err))
+			return EXIT_ERROR
+		}
+		quotas.SetLimits(cfg.QuotaLimits)
+		cfg.Server.Quotas = quotas
+
+		// usage of drained sessions is saved last
+		defer func() {
+			if err := quotas.Save(); err != nil {
+				logger.Error(fmt.Sprintf("Unable to save quotas: %v", err))
+			}
+		}()
+		done := make(chan struct{})
+		defer close(done)
+		go saveQuotas(quotas, cfg.Quotas.SaveInterval, done, logger)
+	}
+
+	server := socks5.NewServer(cfg.Server, logger)
+	if cfg.AccessLog != "" {
+		accessLogger := newAccessLogger(cfg.AccessLog)
+		defer accessLogger.Sync()
+		server.AccessLog = accessLogger
+	}
+	if cfg.MetricsAddress != "" {
+		metrics, metricsServer, err := serveMetrics(cfg.MetricsAddress, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to serve metrics: %v", err))
+			return EXIT_ERROR
+		}
+		defer metricsServer.Close()
+		server.Metrics = metrics
+	}
+	var admin *adminAPI
+	if cfg.Admin.Enabled {
+		admin = newAdminAPI(server, cfg)
+		adminServer, err := serveAdmin(cfg.Admin.Address, admin, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to serve admin API: %v", err))
+			return EXIT_ERROR
+		}
+		defer adminServer.Close()
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	for running := true; running; {
+		select {
+		case err := <-served:
+			logger.Error(err.Error())
+			return EXIT_ERROR
+		case <-hangup:
+			logger.Info("Received hangup, reloading config")
+			cfg = reloadConfig(opts, server, level, cfg, logger)
+			if admin != nil {
+				admin.setConfig(cfg)
+			}
+		case <-reload:
+			logger.Info("Config file changed, reloading config")
+			cfg = reloadConfig(opts, server, level, cfg, logger)
+			if admin != nil {
+				admin.setConfig(cfg)
+			}
+		case sig := <-signals:
+			logger.Info(fmt.Sprintf("Received %v, draining %d sessions", sig, server.ActiveSessions()))
+			running = false
+		}
+	}
+
+	status := drain(server, cfg.DrainTimeout, signals, logger)
+	if err := <-served; err != socks5.ErrServerClosed {
+		logger.Error(err.Error())
+	}
+	return status
+}
+
+// drain waits for active sessions up to timeout, or until one more signal
+// is received, then closes the rest.
+func drain(server *socks5.Server, timeout time.Duration, signals <-chan os.Signal, logger *zap.Logger) int {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Info(fmt.Sprintf("Received %v, closing sessions", sig))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		closed := server.Close()
+		logger.Warn(fmt.Sprintf("Drain is not finished: %v, %d sessions closed", err, closed))
+
+		// let closed sessions log their end
+		ctx, cancel := context.WithTimeout(context.Background(), closeWaitTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		return EXIT_DRAIN_FORCED
+	}
+
+	logger.Info("All sessions are finished")
+	return EXIT_OK
+}
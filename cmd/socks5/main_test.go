@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_drain(t *testing.T) {
+	tests := []struct {
+		name    string
+		session bool
+		signal  bool
+		want    int
+	}{
+		{name: "no sessions", want: EXIT_OK},
+		{name: "timeout", session: true, want: EXIT_DRAIN_FORCED},
+		{name: "second signal", session: true, signal: true, want: EXIT_DRAIN_FORCED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := socks5.NewServer(socks5.Config{Auth: socks5.NO_AUTH, MTU: 1400}, nil)
+			go server.Serve(listener)
+
+			if tt.session {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conn.Write([]byte{socks5.PROTOCOL_VERSION, 0x01, byte(socks5.NO_AUTH)})
+				if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			timeout := 200 * time.Millisecond
+			signals := make(chan os.Signal, 1)
+			if tt.signal {
+				timeout = 0
+				signals <- syscall.SIGTERM
+			}
+
+			if got := drain(server, timeout, signals, zap.NewNop()); got != tt.want {
+				t.Errorf("drain() got = %v, want %v", got, tt.want)
+			}
+			if got := server.ActiveSessions(); got != 0 {
+				t.Errorf("ActiveSessions() after drain got = %v, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+)
+
+// serveMetrics starts Prometheus metrics listener on address,
+// metrics are served on /metrics.
+func serveMetrics(address string, logger *zap.Logger) (*socks5.Metrics, *http.Server, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	metrics, err := socks5.NewMetrics(registry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("Metrics listener error: %v", err))
+		}
+	}()
+
+	logger.Info(fmt.Sprintf("Serving metrics on %s", listener.Addr().String()))
+	return metrics, server, nil
+}
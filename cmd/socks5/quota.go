@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"sort"
+	"time"
+)
+
+const defaultQuotaSaveInterval = time.Minute
+
+type ymlquotas struct {
+	// File keeps the usage, quotas are disabled if it's empty
+	File         string
+	SaveInterval time.Duration `yaml:"save_interval"`
+	// EnforceInSession closes sessions when the quota runs out
+	EnforceInSession bool `yaml:"enforce_in_session"`
+	Default          ymlquota
+	Users            map[string]ymlquota `yaml:",omitempty"`
+}
+
+// ymlquota are byte sizes: 500MB, 50GB, empty is unlimited.
+type ymlquota struct {
+	Daily   string `yaml:",omitempty"`
+	Monthly string `yaml:",omitempty"`
+}
+
+func defaultQuotas() ymlquotas {
+	return ymlquotas{SaveInterval: defaultQuotaSaveInterval}
+}
+
+func parseQuotas(yml ymlquotas) (socks5.QuotaLimits, error) {
+	limits := socks5.QuotaLimits{EnforceInSession: yml.EnforceInSession}
+	quota, err := parseQuota("quotas.default", yml.Default)
+	if err != nil {
+		return socks5.QuotaLimits{}, err
+	}
+	limits.Default = quota
+
+	users := make([]string, 0, len(yml.Users))
+	for user := range yml.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		quota, err := parseQuota("quotas.users."+user, yml.Users[user])
+		if err != nil {
+			return socks5.QuotaLimits{}, err
+		}
+		if limits.Users == nil {
+			limits.Users = map[string]socks5.Quota{}
+		}
+		limits.Users[user] = quota
+	}
+
+	if yml.File == "" && (limits.Default != socks5.Quota{} || len(limits.Users) > 0) {
+		return socks5.QuotaLimits{}, invalid("quotas.file", "must be set to keep usage of quotas")
+	}
+	if yml.File != "" && yml.SaveInterval <= 0 {
+		return socks5.QuotaLimits{}, invalid("quotas.save_interval", "must be positive, got %v", yml.SaveInterval)
+	}
+	return limits, nil
+}
+
+func parseQuota(key string, yml ymlquota) (socks5.Quota, error) {
+	daily, err := parseByteSize(yml.Daily)
+	if err != nil {
+		return socks5.Quota{}, invalid(key+".daily", "%v", err)
+	}
+	monthly, err := parseByteSize(yml.Monthly)
+	if err != nil {
+		return socks5.Quota{}, invalid(key+".monthly", "%v", err)
+	}
+	return socks5.Quota{Daily: daily, Monthly: monthly}, nil
+}
+
+// saveQuotas writes quota usage every interval until done is closed.
+func saveQuotas(quotas *socks5.Quotas, interval time.Duration, done <-chan struct{}, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := quotas.Save(); err != nil {
+			logger.Error(fmt.Sprintf("Unable to save quotas: %v", err))
+		}
+	}
+}
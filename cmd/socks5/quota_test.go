@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"reflect"
+	"testing"
+)
+
+func Test_parseQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     ymlquotas
+		want    socks5.QuotaLimits
+		wantKey string
+	}{
+		{"disabled", defaultQuotas(), socks5.QuotaLimits{}, ""},
+		{"users", ymlquotas{File: "quotas.json", SaveInterval: defaultQuotaSaveInterval, EnforceInSession: true,
+			Default: ymlquota{Daily: "1GB"},
+			Users:   map[string]ymlquota{"contractor": {Monthly: "50GB"}},
+		}, socks5.QuotaLimits{
+			Default:          socks5.Quota{Daily: 1 << 30},
+			Users:            map[string]socks5.Quota{"contractor": {Monthly: 50 << 30}},
+			EnforceInSession: true,
+		}, ""},
+		{"without file", ymlquotas{Default: ymlquota{Monthly: "1GB"}}, socks5.QuotaLimits{}, "quotas.file"},
+		{"invalid size", ymlquotas{File: "quotas.json", Users: map[string]ymlquota{"bob": {Daily: "a lot"}}}, socks5.QuotaLimits{}, "quotas.users.bob.daily"},
+		{"save interval", ymlquotas{File: "quotas.json"}, socks5.QuotaLimits{}, "quotas.save_interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQuotas(tt.yml)
+			if tt.wantKey != "" {
+				if keyErr, ok := err.(*keyError); !ok || keyErr.key != tt.wantKey {
+					t.Errorf("parseQuotas() error = %v, want key %v", err, tt.wantKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQuotas() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretKeys are compared through loaded credentials,
+// their values are never logged.
+var secretKeys = map[string]bool{"user": true, "pass": true, "users": true, "htpasswd": true}
+
+// hiddenKeys are reported as changed without values.
+var hiddenKeys = map[string]bool{"admin.token": true}
+
+// restartKeys can't be applied by reload, log and admin keys except
+// log.level and admin.token too.
+var restartKeys = map[string]bool{"network": true, "address": true, "port": true, "watch_interval": true, "metrics_address": true, "access_log": true, "quotas.file": true, "quotas.save_interval": true}
+
+var reloadableKeys = map[string]bool{"log.level": true, "admin.token": true}
+
+func requiresRestart(key string) bool {
+	if restartKeys[key] {
+		return true
+	}
+	return (strings.HasPrefix(key, "log.") || strings.HasPrefix(key, "admin.")) && !reloadableKeys[key]
+}
+
+// reloadConfig loads the config and applies it to new sessions.
+// Invalid config is rejected and current one is returned.
+func reloadConfig(opts options, server *socks5.Server, level zap.AtomicLevel, current config, logger *zap.Logger) config {
+	next, err := loadConfig(opts)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Config reload rejected: %v", err))
+		return current
+	}
+
+	changes := diffConfig(current, next)
+	if len(changes) == 0 {
+		logger.Info("Config reloaded, nothing changed")
+		return current
+	}
+
+	next = keepRunning(current, next)
+	// usage is kept by the current quotas
+	next.Server.Quotas = current.Server.Quotas
+	next.Server.Quotas.SetLimits(next.QuotaLimits)
+	server.Reload(next.Server)
+	// validated by loadConfig
+	nextLevel, _ := parseLevel(next.Log.Level)
+	level.SetLevel(nextLevel)
+	for _, change := range changes {
+		logger.Info("Config changed: " + change)
+	}
+	return next
+}
+
+// keepRunning returns next with values of keys requiring restart taken
+// from current, so it tells what is running and the next reload reports
+// these keys again.
+func keepRunning(current, next config) config {
+	keepValues("", reflect.ValueOf(current.yml), reflect.ValueOf(&next.yml).Elem())
+	next.Server.Network = next.yml.Network
+	next.Server.Address = next.yml.Address
+	next.Server.Port = next.yml.Port
+	next.WatchInterval = next.yml.WatchInterval
+	next.MetricsAddress = next.yml.MetricsAddress
+	next.AccessLog = next.yml.AccessLog
+	next.Log = next.yml.Log
+	next.Admin = next.yml.Admin
+	next.Quotas = next.yml.Quotas
+	return next
+}
+
+// keepValues copies fields of keys requiring restart from old to new,
+// nested structs are walked with dotted keys like diffValues.
+func keepValues(prefix string, old, new reflect.Value) {
+	for i := 0; i < old.NumField(); i++ {
+		key := prefix + yamlKey(old.Type().Field(i))
+		if old.Field(i).Kind() == reflect.Struct {
+			keepValues(key+".", old.Field(i), new.Field(i))
+			continue
+		}
+		if requiresRestart(key) {
+			new.Field(i).Set(old.Field(i))
+		}
+	}
+}
+
+// diffConfig describes changed settings, passwords are not shown.
+func diffConfig(old, new config) []string {
+	changes := diffValues("", reflect.ValueOf(old.yml), reflect.ValueOf(new.yml))
+	return append(changes, diffCredentials(old.credentials, new.credentials)...)
+}
+
+// diffValues compares struct fields, nested structs are compared
+// field by field with dotted keys.
+func diffValues(prefix string, old, new reflect.Value) []string {
+	var changes []string
+	for i := 0; i < old.NumField(); i++ {
+		key := prefix + yamlKey(old.Type().Field(i))
+		a, b := old.Field(i).Interface(), new.Field(i).Interface()
+		if secretKeys[key] || reflect.DeepEqual(a, b) {
+			continue
+		}
+
+		change := key + " changed"
+		switch old.Field(i).Kind() {
+		case reflect.Struct:
+			changes = append(changes, diffValues(key+".", old.Field(i), new.Field(i))...)
+			continue
+		case reflect.String:
+			if !hiddenKeys[key] {
+				change = fmt.Sprintf("%s: %q -> %q", key, a, b)
+			}
+		case reflect.Int, reflect.Int64, reflect.Bool:
+			change = fmt.Sprintf("%s: %v -> %v", key, a, b)
+		}
+		if requiresRestart(key) {
+			change += " (requires restart)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func diffCredentials(old, new socks5.Credentials) []string {
+	var changes []string
+	for user, pass := range new {
+		oldPass, ok := old[user]
+		if !ok {
+			changes = append(changes, "user added: "+user)
+		} else if oldPass != pass {
+			changes = append(changes, "password changed: "+user)
+		}
+	}
+	for user := range old {
+		if _, ok := new[user]; !ok {
+			changes = append(changes, "user removed: "+user)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func yamlKey(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("yaml"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// watchConfig requests reload when modification time or size
+// of the file is changed, until done is closed.
+func watchConfig(filename string, interval time.Duration, reload chan<- struct{}, done <-chan struct{}) {
+	last, _ := os.Stat(filename)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
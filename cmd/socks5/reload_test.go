@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_diffConfig(t *testing.T) {
+	base := ymlconfig{Address: "127.0.0.1", Port: 1080, Auth: "PASS", Pass: "secret", IdleTimeout: time.Minute, Log: defaultLog()}
+
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		want   []string
+	}{
+		{"nothing", func(cfg *config) {}, nil},
+		{"timeout", func(cfg *config) { cfg.yml.IdleTimeout = 5 * time.Minute }, []string{"idle_timeout: 1m0s -> 5m0s"}},
+		{"port", func(cfg *config) { cfg.yml.Port = 1081 }, []string{"port: 1080 -> 1081 (requires restart)"}},
+		{"ruleset", func(cfg *config) { cfg.yml.Ruleset.Default = "deny" }, []string{`ruleset.default: "" -> "deny"`}},
+		{"rules", func(cfg *config) { cfg.yml.Ruleset.Rules = []ymlrule{{Action: "deny"}} }, []string{"ruleset.rules changed"}},
+		{"log level", func(cfg *config) { cfg.yml.Log.Level = "debug" }, []string{`log.level: "info" -> "debug"`}},
+		{"log output", func(cfg *config) { cfg.yml.Log.Output = "stdout" }, []string{`log.output: "file" -> "stdout" (requires restart)`}},
+		{"bandwidth", func(cfg *config) { cfg.yml.Bandwidth.PerUser.Download = "1MB" }, []string{`bandwidth.per_user.download: "" -> "1MB"`}},
+		{"admin token", func(cfg *config) { cfg.yml.Admin.Token = "secret" }, []string{"admin.token changed"}},
+		{"admin enabled", func(cfg *config) { cfg.yml.Admin.Enabled = true }, []string{"admin.enabled: false -> true (requires restart)"}},
+		{"password", func(cfg *config) {
+			cfg.yml.Pass = "new secret"
+			cfg.credentials = socks5.Credentials{"alice": "new secret", "bob": "secret"}
+		}, []string{"password changed: alice", "user added: bob"}},
+		{"user removed", func(cfg *config) { cfg.credentials = socks5.Credentials{} }, []string{"user removed: alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := config{yml: base, credentials: socks5.Credentials{"alice": "secret"}}
+			new := config{yml: base, credentials: socks5.Credentials{"alice": "secret"}}
+			tt.change(&new)
+			if got := diffConfig(old, new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffConfig() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "socks5.yaml")
+	opts := options{configFile: filename}
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("address: 127.0.0.1\nport: 1080\nauth: NO\nmtu: 1400\n")
+	current, err := loadConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := socks5.NewServer(current.Server, nil)
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+
+	write("address: 127.0.0.1\nport: 1080\nauth: UNKNOWN\n")
+	if got := reloadConfig(opts, server, level, current, zap.NewNop()); got.yml.Auth != "NO" {
+		t.Errorf("reloadConfig() applied invalid config, auth = %v", got.yml.Auth)
+	}
+
+	write("address: 127.0.0.1\nport: 1080\nauth: PASS\nuser: alice\npass: secret\nmtu: 1400\nlog:\n  level: debug\n")
+	if got := reloadConfig(opts, server, level, current, zap.NewNop()); got.yml.Auth != "PASS" {
+		t.Errorf("reloadConfig() auth got = %v, want PASS", got.yml.Auth)
+	}
+	if server.Config.Auth != socks5.PASS_AUTH {
+		t.Errorf("server auth after reload got = %v, want %v", server.Config.Auth, socks5.PASS_AUTH)
+	}
+	if level.Level() != zap.DebugLevel {
+		t.Errorf("log level after reload got = %v, want %v", level.Level(), zap.DebugLevel)
+	}
+}
+
+func Test_reloadConfig_restartKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "socks5.yaml")
+	opts := options{configFile: filename}
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("port: 1080\nidle_timeout: 1m\n")
+	current, err := loadConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := socks5.NewServer(current.Server, nil)
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+
+	write("port: 1081\nidle_timeout: 2m\nlog:\n  output: stdout\n")
+	current = reloadConfig(opts, server, level, current, zap.NewNop())
+	if current.yml.Port != 1080 || current.Server.Port != 1080 || current.yml.Log.Output != LOG_FILE || current.Log.Output != LOG_FILE {
+		t.Errorf("reloadConfig() applied restart keys, port = %v, log output = %v", current.yml.Port, current.yml.Log.Output)
+	}
+	if current.yml.IdleTimeout != 2*time.Minute {
+		t.Errorf("reloadConfig() idle_timeout got = %v, want %v", current.yml.IdleTimeout, 2*time.Minute)
+	}
+
+	// the file is unchanged, restart keys still differ from running ones
+	next, err := loadConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"port: 1080 -> 1081 (requires restart)", `log.output: "file" -> "stdout" (requires restart)`}
+	if got := diffConfig(current, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig() on second reload got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type ymlruleset struct {
+	Default         string
+	ResolveUpstream bool `yaml:"resolve_upstream"`
+	Rules           []ymlrule
+}
+
+type ymlrule struct {
+	Name         string
+	Action       string
+	Destinations []string
+	Domains      []string
+	Ports        []string
+	Commands     []string
+	Sources      []string
+	Users        []string
+}
+
+// parseRuleSet returns nil if no rules are defined and default action is allow.
+func parseRuleSet(yml ymlruleset) (*socks5.RuleSet, error) {
+	defaultAllow, err := parseAction(yml.Default, true)
+	if err != nil {
+		return nil, fmt.Errorf("ruleset default: %v", err)
+	}
+	if len(yml.Rules) == 0 && defaultAllow {
+		return nil, nil
+	}
+
+	ruleset := &socks5.RuleSet{DefaultAllow: defaultAllow, ResolveUpstream: yml.ResolveUpstream}
+	for i, ymlrule := range yml.Rules {
+		rule, err := parseRule(ymlrule)
+		if err != nil {
+			name := ymlrule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		ruleset.Rules = append(ruleset.Rules, rule)
+	}
+	return ruleset, nil
+}
+
+func parseRule(yml ymlrule) (socks5.Rule, error) {
+	if yml.Action == "" {
+		return socks5.Rule{}, fmt.Errorf("action not defined")
+	}
+	allow, err := parseAction(yml.Action, false)
+	if err != nil {
+		return socks5.Rule{}, err
+	}
+
+	rule := socks5.Rule{
+		Name:    yml.Name,
+		Allow:   allow,
+		Domains: yml.Domains,
+		Users:   yml.Users,
+	}
+
+	if rule.Destinations, err = parseNetworks(yml.Destinations); err != nil {
+		return socks5.Rule{}, err
+	}
+	if rule.Sources, err = parseNetworks(yml.Sources); err != nil {
+		return socks5.Rule{}, err
+	}
+
+	for _, s := range yml.Ports {
+		r, err := parsePortRange(s)
+		if err != nil {
+			return socks5.Rule{}, err
+		}
+		rule.Ports = append(rule.Ports, r)
+	}
+
+	for _, s := range yml.Commands {
+		switch strings.ToLower(s) {
+		case "connect":
+			rule.Commands = append(rule.Commands, socks5.CMD_CONNECT)
+		case "bind":
+			rule.Commands = append(rule.Commands, socks5.CMD_BIND)
+		case "udp":
+			rule.Commands = append(rule.Commands, socks5.CMD_UDP)
+		default:
+			return socks5.Rule{}, fmt.Errorf("unknown command %q", s)
+		}
+	}
+
+	return rule, nil
+}
+
+func parseAction(s string, empty bool) (bool, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return empty, nil
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %q", s)
+}
+
+// parseNetworks accepts CIDR or single IP address.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parsePortRange accepts single port "80" or range "8000-9000".
+func parsePortRange(s string) (socks5.PortRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return socks5.PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return socks5.PortRange{}, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if from < 0 || to > 65535 || from > to {
+		return socks5.PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return socks5.PortRange{From: from, To: to}, nil
+}
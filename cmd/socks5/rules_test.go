@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/NeekUP/socks5"
+	"reflect"
+	"testing"
+)
+
+func Test_parsePortRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    socks5.PortRange
+		wantErr bool
+	}{
+		{"single", "80", socks5.PortRange{From: 80, To: 80}, false},
+		{"range", "8000-9000", socks5.PortRange{From: 8000, To: 9000}, false},
+		{"reversed", "9000-8000", socks5.PortRange{}, true},
+		{"out of range", "1-70000", socks5.PortRange{}, true},
+		{"not a number", "http", socks5.PortRange{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePortRange(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePortRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parsePortRange() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRuleSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   ymlruleset
+		want    int
+		wantNil bool
+		wantErr bool
+	}{
+		{"empty", ymlruleset{}, 0, true, false},
+		{"deny by default", ymlruleset{Default: "deny"}, 0, false, false},
+		{"valid", ymlruleset{Rules: []ymlrule{
+			{Action: "deny", Ports: []string{"25"}},
+			{Action: "allow", Destinations: []string{"10.0.0.0/8", "192.168.0.1", "::1"}, Commands: []string{"connect", "UDP"}},
+		}}, 2, false, false},
+		{"without action", ymlruleset{Rules: []ymlrule{{Ports: []string{"25"}}}}, 0, true, true},
+		{"unknown action", ymlruleset{Rules: []ymlrule{{Action: "reject"}}}, 0, true, true},
+		{"unknown default", ymlruleset{Default: "reject"}, 0, true, true},
+		{"invalid cidr", ymlruleset{Rules: []ymlrule{{Action: "deny", Sources: []string{"10.0.0.0/33"}}}}, 0, true, true},
+		{"unknown command", ymlruleset{Rules: []ymlrule{{Action: "deny", Commands: []string{"listen"}}}}, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRuleSet(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRuleSet() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("parseRuleSet() got = %v, wantNil %v", got, tt.wantNil)
+			}
+			if got != nil && len(got.Rules) != tt.want {
+				t.Errorf("parseRuleSet() got %v rules, want %v", len(got.Rules), tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseNetworks(t *testing.T) {
+	got, err := parseNetworks([]string{"192.168.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.168.0.1/32", "10.0.0.0/8"}
+	var strs []string
+	for _, network := range got {
+		strs = append(strs, network.String())
+	}
+	if !reflect.DeepEqual(strs, want) {
+		t.Errorf("parseNetworks() got = %v, want %v", strs, want)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ENV_PREFIX is the prefix of environment variables,
+// e.g. SOCKS5_PORT overrides port.
+const ENV_PREFIX = "SOCKS5_"
+
+// setting is a config key which can be overridden by a flag and
+// an environment variable. Precedence: flags, environment, config file,
+// defaults.
+type setting struct {
+	// key is the yaml key, nested keys are dotted: log.level.
+	// Flag name is the key with dashes: -log-level,
+	// variable is SOCKS5_LOG_LEVEL
+	key   string
+	usage string
+}
+
+var settings = []setting{
+	{"network", "listen network: tcp, tcp4, tcp6"},
+	{"address", "listen address"},
+	{"port", "listen port"},
+	{"auth", "authentication: NO, PASS"},
+	{"user", "username for PASS auth"},
+	{"pass", "password for PASS auth"},
+	{"htpasswd", "htpasswd file with users"},
+	{"mtu", "relay buffer size"},
+	{"socks4", "accept SOCKS4 and SOCKS4a clients, NO auth only"},
+	{"handshake_timeout", "limit of negotiation, authentication and request"},
+	{"connect_timeout", "limit of outbound connection and BIND accept"},
+	{"idle_timeout", "close sessions without data in either direction"},
+	{"max_session_lifetime", "close sessions regardless of activity"},
+	{"drain_timeout", "limit of waiting for active sessions on shutdown"},
+	{"watch_interval", "period of config file checks, 0 disables"},
+	{"metrics_address", "host:port of Prometheus metrics listener, empty disables"},
+	{"access_log", "session records: stdout, stderr or file, empty disables"},
+	{"log.level", "log level: debug, info, warn, error"},
+	{"log.output", "log output: file, stdout, stderr, syslog"},
+	{"log.file", "log file of file output"},
+	{"log.encoding", "log encoding: json, console"},
+	{"log.max_size", "megabytes of the log file before rotation"},
+	{"log.max_backups", "rotated log files to keep"},
+	{"log.max_age", "days to keep rotated log files"},
+	{"log.compress", "compress rotated log files"},
+	{"log.syslog_tag", "tag of syslog messages"},
+	{"log.sampling.initial", "messages logged per second before sampling, 0 disables"},
+	{"log.sampling.thereafter", "every Nth message is logged after initial ones"},
+	{"limits.max_sessions", "limit of all sessions, 0 is unlimited"},
+	{"limits.max_sessions_per_client", "limit of sessions from a client IP, 0 is unlimited"},
+	{"limits.max_sessions_per_user", "limit of sessions of a user, 0 is unlimited"},
+	{"limits.accept_rate", "new connections per second, 0 is unlimited"},
+	{"limits.accept_burst", "new connections accepted at once, defaults to accept_rate"},
+	{"quotas.file", "file of quota usage, empty disables quotas"},
+	{"quotas.save_interval", "period of quota usage saving"},
+	{"quotas.enforce_in_session", "close sessions when the quota runs out"},
+	{"auth_protection.base_delay", "delay of the first failed authentication, doubled on every next one"},
+	{"auth_protection.max_delay", "limit of the failed authentication delay"},
+	{"auth_protection.max_failures", "failures of a client IP or user before lockout, 0 disables"},
+	{"auth_protection.failure_window", "period failures are counted in"},
+	{"auth_protection.lockout", "lockout duration, 0 disables"},
+	{"admin.enabled", "serve admin HTTP API"},
+	{"admin.address", "host:port of admin HTTP API"},
+	{"admin.token", "bearer token of admin HTTP API"},
+}
+
+// override is a value of a setting given by flag or environment.
+type override struct {
+	value string
+	// source is the flag or the variable name
+	source string
+}
+
+// options are settings of the command line.
+type options struct {
+	configFile string
+	// configOptional allows missing config file,
+	// it's set when the default path is used
+	configOptional bool
+	checkConfig    bool
+	overrides      map[string]override
+}
+
+var keySeparators = strings.NewReplacer("_", "-", ".", "-")
+
+func flagName(key string) string {
+	return keySeparators.Replace(key)
+}
+
+func envName(key string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName(key), "-", "_", -1))
+}
+
+// settingFlag keeps the flag value as given, it's parsed with the config.
+// Bool settings are set without value: -log-compress.
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// parseOptions parses command line arguments and environment,
+// lookupEnv is os.LookupEnv.
+func parseOptions(args []string, lookupEnv func(string) (string, bool), output io.Writer) (options, error) {
+	fs := flag.NewFlagSet("socks5", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	configFile := fs.String("config", configFilename, "config file, env "+envName("config"))
+	logFile := fs.String("log", "", "alias of -log-file, env "+envName("log"))
+	checkConfig := fs.Bool("check-config", false, "validate and print the effective config, then exit")
+	values := map[string]*settingFlag{}
+	for _, s := range settings {
+		field, _ := fieldByKey(reflect.ValueOf(ymlconfig{}), s.key)
+		values[s.key] = &settingFlag{isBool: field.Kind() == reflect.Bool}
+		fs.Var(values[s.key], flagName(s.key), s.usage+", env "+envName(s.key))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument %s", fs.Arg(0))
+		fmt.Fprintln(output, err)
+		return options{}, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	opts := options{
+		configFile:     *configFile,
+		configOptional: true,
+		checkConfig:    *checkConfig,
+		overrides:      map[string]override{},
+	}
+	if set["config"] {
+		opts.configOptional = false
+	} else if value, ok := lookupEnv(envName("config")); ok {
+		opts.configFile, opts.configOptional = value, false
+	}
+
+	if set["log"] {
+		opts.overrides["log.file"] = override{value: *logFile, source: "-log"}
+	} else if value, ok := lookupEnv(envName("log")); ok {
+		opts.overrides["log.file"] = override{value: value, source: envName("log")}
+	}
+
+	for _, s := range settings {
+		if set[flagName(s.key)] {
+			opts.overrides[s.key] = override{value: values[s.key].value, source: "-" + flagName(s.key)}
+		} else if value, ok := lookupEnv(envName(s.key)); ok {
+			if o, ok := opts.overrides[s.key]; ok && strings.HasPrefix(o.source, "-") {
+				// -log flag wins over SOCKS5_LOG_FILE
+				continue
+			}
+			opts.overrides[s.key] = override{value: value, source: envName(s.key)}
+		}
+	}
+	return opts, nil
+}
+
+// applyOverrides sets fields of ymlcfg by their yaml keys.
+func applyOverrides(ymlcfg *ymlconfig, overrides map[string]override) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := overrides[key]
+		field, ok := fieldByKey(reflect.ValueOf(ymlcfg).Elem(), key)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %s", o.source, key)
+		}
+
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(o.value)
+		case int:
+			n, err := strconv.Atoi(o.value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", o.source, o.value)
+			}
+			field.SetInt(int64(n))
+		case bool:
+			b, err := strconv.ParseBool(o.value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid boolean %q", o.source, o.value)
+			}
+			field.SetBool(b)
+		case time.Duration:
+			d, err := time.ParseDuration(o.value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid duration %q", o.source, o.value)
+			}
+			field.SetInt(int64(d))
+		default:
+			return fmt.Errorf("%s: unsupported setting", o.source)
+		}
+	}
+	return nil
+}
+
+// fieldByKey finds the struct field by dotted yaml key.
+func fieldByKey(value reflect.Value, key string) (reflect.Value, bool) {
+	for _, part := range strings.Split(key, ".") {
+		if value.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			if yamlKey(value.Type().Field(i)) == part {
+				value, found = value.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false
+		}
+	}
+	return value, true
+}
+
+const redacted = "<redacted>"
+
+// printConfig writes the effective config as yaml, passwords are redacted.
+func printConfig(w io.Writer, ymlcfg ymlconfig) error {
+	ymlcfg.Pass = redact(ymlcfg.Pass)
+	users := make([]ymluser, len(ymlcfg.Users))
+	for i, user := range ymlcfg.Users {
+		users[i] = ymluser{Name: user.Name, Pass: redact(user.Pass)}
+	}
+	ymlcfg.Users = users
+
+	chains := map[string][]ymlproxy{}
+	for name, proxies := range ymlcfg.Upstream.Chains {
+		chain := make([]ymlproxy, len(proxies))
+		for i, proxy := range proxies {
+			chain[i] = proxy
+			chain[i].Pass = redact(proxy.Pass)
+		}
+		chains[name] = chain
+	}
+	ymlcfg.Upstream.Chains = chains
+	ymlcfg.Admin.Token = redact(ymlcfg.Admin.Token)
+
+	// durations are printed as strings, they are numbers otherwise
+	var out yaml.MapSlice
+	value := reflect.ValueOf(ymlcfg)
+	for i := 0; i < value.NumField(); i++ {
+		item := yaml.MapItem{Key: yamlKey(value.Type().Field(i)), Value: value.Field(i).Interface()}
+		if d, ok := item.Value.(time.Duration); ok {
+			item.Value = d.String()
+		}
+		out = append(out, item)
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
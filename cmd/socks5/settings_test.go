@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		env           map[string]string
+		wantOverrides map[string]override
+		wantConfig    string
+		wantOptional  bool
+		wantErr       bool
+	}{
+		{"defaults", nil, nil, map[string]override{}, configFilename, true, false},
+		{"flag", []string{"-port", "1081", "-idle-timeout", "1m"}, nil, map[string]override{
+			"port":         {"1081", "-port"},
+			"idle_timeout": {"1m", "-idle-timeout"},
+		}, configFilename, true, false},
+		{"env", nil, map[string]string{"SOCKS5_PORT": "1082", "SOCKS5_CONFIG": "/etc/socks5.yaml"}, map[string]override{
+			"port": {"1082", "SOCKS5_PORT"},
+		}, "/etc/socks5.yaml", false, false},
+		{"flag over env", []string{"-port=1081", "-config", "a.yaml"}, map[string]string{"SOCKS5_PORT": "1082", "SOCKS5_CONFIG": "b.yaml"}, map[string]override{
+			"port": {"1081", "-port"},
+		}, "a.yaml", false, false},
+		{"nested", []string{"-log-level", "debug"}, map[string]string{"SOCKS5_LOG_SAMPLING_INITIAL": "100"}, map[string]override{
+			"log.level":            {"debug", "-log-level"},
+			"log.sampling.initial": {"100", "SOCKS5_LOG_SAMPLING_INITIAL"},
+		}, configFilename, true, false},
+		{"log alias", []string{"-log", "/var/log/socks5.log"}, map[string]string{"SOCKS5_LOG_FILE": "env.log"}, map[string]override{
+			"log.file": {"/var/log/socks5.log", "-log"},
+		}, configFilename, true, false},
+		{"log alias env", nil, map[string]string{"SOCKS5_LOG": "alias.log", "SOCKS5_LOG_FILE": "env.log"}, map[string]override{
+			"log.file": {"env.log", "SOCKS5_LOG_FILE"},
+		}, configFilename, true, false},
+		{"bool flag", []string{"-admin-enabled", "-log-compress=false"}, nil, map[string]override{
+			"admin.enabled": {"true", "-admin-enabled"},
+			"log.compress":  {"false", "-log-compress"},
+		}, configFilename, true, false},
+		{"unknown flag", []string{"-unknown", "1"}, nil, nil, "", false, true},
+		{"argument", []string{"socks5.yaml"}, nil, nil, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupEnv := func(key string) (string, bool) {
+				value, ok := tt.env[key]
+				return value, ok
+			}
+			got, err := parseOptions(tt.args, lookupEnv, ioutil.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.overrides, tt.wantOverrides) {
+				t.Errorf("parseOptions() overrides got = %v, want %v", got.overrides, tt.wantOverrides)
+			}
+			if got.configFile != tt.wantConfig || got.configOptional != tt.wantOptional {
+				t.Errorf("parseOptions() config got = %v %v, want %v %v", got.configFile, got.configOptional, tt.wantConfig, tt.wantOptional)
+			}
+		})
+	}
+}
+
+func Test_applyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]override
+		want      ymlconfig
+		wantErr   bool
+	}{
+		{"values", map[string]override{
+			"address":           {"0.0.0.0", "-address"},
+			"port":              {"1080", "SOCKS5_PORT"},
+			"handshake_timeout": {"10s", "-handshake-timeout"},
+		}, ymlconfig{Network: "tcp", Address: "0.0.0.0", Port: 1080, HandshakeTimeout: 10 * time.Second}, false},
+		{"nested", map[string]override{
+			"log.compress":            {"true", "-log-compress"},
+			"log.sampling.thereafter": {"10", "-log-sampling-thereafter"},
+		}, ymlconfig{Network: "tcp", Address: "127.0.0.1", Log: ymllog{Compress: true, Sampling: ymlsampling{Thereafter: 10}}}, false},
+		{"invalid number", map[string]override{"port": {"http", "SOCKS5_PORT"}}, ymlconfig{}, true},
+		{"invalid boolean", map[string]override{"log.compress": {"maybe", "-log-compress"}}, ymlconfig{}, true},
+		{"invalid duration", map[string]override{"idle_timeout": {"10", "-idle-timeout"}}, ymlconfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ymlconfig{Network: "tcp", Address: "127.0.0.1"}
+			err := applyOverrides(&got, tt.overrides)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("applyOverrides() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applyOverrides() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_settings(t *testing.T) {
+	for _, s := range settings {
+		if _, ok := fieldByKey(reflect.ValueOf(ymlconfig{}), s.key); !ok {
+			t.Errorf("setting %s is not a config field", s.key)
+		}
+	}
+}
+
+func Test_printConfig(t *testing.T) {
+	cfg := ymlconfig{
+		Address:     "127.0.0.1",
+		User:        "alice",
+		Pass:        "secret",
+		Users:       []ymluser{{Name: "bob", Pass: "hunter2"}},
+		IdleTimeout: 5 * time.Minute,
+		Upstream: ymlupstream{Chains: map[string][]ymlproxy{
+			"corp": {{Type: "http", Address: "proxy:3128", User: "carol", Pass: "topsecret"}},
+		}},
+	}
+
+	var out bytes.Buffer
+	if err := printConfig(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"secret", "hunter2", "topsecret"} {
+		if strings.Contains(out.String(), secret+"\n") {
+			t.Errorf("printConfig() shows password %s:\n%s", secret, out.String())
+		}
+	}
+	for _, want := range []string{"user: alice", "idle_timeout: 5m0s", "name: bob", redacted} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("printConfig() doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if cfg.Users[0].Pass != "hunter2" || cfg.Upstream.Chains["corp"][0].Pass != "topsecret" {
+		t.Error("printConfig() changed the config")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"go.uber.org/zap/zapcore"
+	"log/syslog"
+)
+
+func newSyslogSink(tag string) (zapcore.WriteSyncer, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return zapcore.AddSync(writer), nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogSink(tag string) (zapcore.WriteSyncer, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NeekUP/socks5"
+	"strings"
+)
+
+type ymlupstream struct {
+	Chains  map[string][]ymlproxy
+	Routes  []ymlroute
+	Default string
+}
+
+type ymlproxy struct {
+	Type    string
+	Address string
+	User    string
+	Pass    string
+}
+
+type ymlroute struct {
+	Domains      []string
+	Destinations []string
+	Chain        string
+}
+
+const directRoute = "direct"
+
+// parseRouter returns nil if nothing goes through upstream proxies.
+func parseRouter(yml ymlupstream) (*socks5.Router, error) {
+	chains := map[string]*socks5.Chain{}
+	for name, proxies := range yml.Chains {
+		if name == directRoute {
+			return nil, fmt.Errorf("chain name %q is reserved", directRoute)
+		}
+		if len(proxies) == 0 {
+			return nil, fmt.Errorf("chain %s: no upstream proxies", name)
+		}
+
+		chain := &socks5.Chain{Name: name}
+		for _, proxy := range proxies {
+			upstream, err := parseUpstream(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("chain %s: %v", name, err)
+			}
+			chain.Upstreams = append(chain.Upstreams, upstream)
+		}
+		chains[name] = chain
+	}
+
+	dialer := func(name string) (socks5.Dialer, error) {
+		if name == "" || name == directRoute {
+			return nil, nil
+		}
+		chain, ok := chains[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown chain %q", name)
+		}
+		return chain, nil
+	}
+
+	router := &socks5.Router{}
+	var err error
+	if router.Default, err = dialer(yml.Default); err != nil {
+		return nil, fmt.Errorf("default route: %v", err)
+	}
+
+	for i, ymlroute := range yml.Routes {
+		route := socks5.Route{Domains: ymlroute.Domains}
+		if route.Dialer, err = dialer(ymlroute.Chain); err != nil {
+			return nil, fmt.Errorf("route #%d: %v", i+1, err)
+		}
+		if route.Destinations, err = parseNetworks(ymlroute.Destinations); err != nil {
+			return nil, fmt.Errorf("route #%d: %v", i+1, err)
+		}
+		router.Routes = append(router.Routes, route)
+	}
+
+	if len(router.Routes) == 0 && router.Default == nil {
+		return nil, nil
+	}
+	return router, nil
+}
+
+func parseUpstream(yml ymlproxy) (socks5.Upstream, error) {
+	upstream := socks5.Upstream{
+		Type:    strings.ToLower(yml.Type),
+		Address: yml.Address,
+		User:    yml.User,
+		Pass:    yml.Pass,
+	}
+
+	switch upstream.Type {
+	case socks5.UPSTREAM_SOCKS5:
+		if len(upstream.User) > 255 || len(upstream.Pass) > 255 {
+			return socks5.Upstream{}, fmt.Errorf("upstream %s: user or password is too long", yml.Address)
+		}
+	case socks5.UPSTREAM_HTTP:
+	default:
+		return socks5.Upstream{}, fmt.Errorf("unknown upstream type %q", yml.Type)
+	}
+
+	if upstream.Address == "" {
+		return socks5.Upstream{}, fmt.Errorf("upstream address is empty")
+	}
+	return upstream, nil
+}
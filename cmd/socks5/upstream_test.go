@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_parseRouter(t *testing.T) {
+	corp := map[string][]ymlproxy{
+		"corp": {
+			{Type: "HTTP", Address: "proxy.corp:3128"},
+			{Type: "socks5", Address: "10.0.0.1:1080", User: "user", Pass: "pass"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		input   ymlupstream
+		wantNil bool
+		wantErr bool
+	}{
+		{"empty", ymlupstream{}, true, false},
+		{"chains without routes", ymlupstream{Chains: corp}, true, false},
+		{"default chain", ymlupstream{Chains: corp, Default: "corp"}, false, false},
+		{"routes", ymlupstream{Chains: corp, Routes: []ymlroute{
+			{Domains: []string{"*.corp"}, Chain: "corp"},
+			{Destinations: []string{"10.0.0.0/8"}, Chain: "direct"},
+		}}, false, false},
+		{"unknown chain", ymlupstream{Chains: corp, Default: "home"}, true, true},
+		{"unknown type", ymlupstream{Chains: map[string][]ymlproxy{"corp": {{Type: "socks4", Address: "a:1"}}}}, true, true},
+		{"empty address", ymlupstream{Chains: map[string][]ymlproxy{"corp": {{Type: "http"}}}}, true, true},
+		{"reserved name", ymlupstream{Chains: map[string][]ymlproxy{"direct": {{Type: "http", Address: "a:1"}}}}, true, true},
+		{"invalid destination", ymlupstream{Chains: corp, Routes: []ymlroute{{Destinations: []string{"10.0.0.0/40"}, Chain: "corp"}}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRouter(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRouter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("parseRouter() got = %v, wantNil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MIN_MTU            = 512
+	MAX_MTU            = 65535
+	MIN_WATCH_INTERVAL = time.Second
+)
+
+// defaultConfig is the config before the file and overrides are applied.
+func defaultConfig() ymlconfig {
+	return ymlconfig{
+		Network:          "tcp",
+		Address:          "127.0.0.1",
+		Port:             1080,
+		Auth:             "NO",
+		MTU:              1400,
+		SOCKS4:           true,
+		HandshakeTimeout: 30 * time.Second,
+		ConnectTimeout:   30 * time.Second,
+		DrainTimeout:     30 * time.Second,
+		Log:              defaultLog(),
+		Admin:            defaultAdmin(),
+		Quotas:           defaultQuotas(),
+		AuthProtection:   defaultAuthProtection(),
+	}
+}
+
+// keyError is an invalid value of the config key.
+type keyError struct {
+	key string
+	err error
+}
+
+func (e *keyError) Error() string {
+	return e.key + ": " + e.err.Error()
+}
+
+func invalid(key string, format string, args ...interface{}) error {
+	return &keyError{key: key, err: fmt.Errorf(format, args...)}
+}
+
+// validateConfig checks plain values, sections are validated
+// when they are parsed.
+func validateConfig(yml ymlconfig) error {
+	switch yml.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return invalid("network", "unsupported network %q, expected tcp, tcp4 or tcp6", yml.Network)
+	}
+	if yml.Address == "" {
+		return invalid("address", "must not be empty")
+	}
+	if yml.Port < 1 || yml.Port > 65535 {
+		return invalid("port", "must be between 1 and 65535, got %d", yml.Port)
+	}
+	switch strings.ToUpper(yml.Auth) {
+	case "NO", "PASS":
+	default:
+		return invalid("auth", "unknown type %q, expected NO or PASS", yml.Auth)
+	}
+	if yml.MTU < MIN_MTU || yml.MTU > MAX_MTU {
+		return invalid("mtu", "must be between %d and %d, got %d", MIN_MTU, MAX_MTU, yml.MTU)
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"handshake_timeout", yml.HandshakeTimeout},
+		{"connect_timeout", yml.ConnectTimeout},
+		{"idle_timeout", yml.IdleTimeout},
+		{"max_session_lifetime", yml.MaxSessionLifetime},
+		{"drain_timeout", yml.DrainTimeout},
+		{"watch_interval", yml.WatchInterval},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return invalid(d.key, "must not be negative, got %v", d.value)
+		}
+	}
+	if yml.WatchInterval > 0 && yml.WatchInterval < MIN_WATCH_INTERVAL {
+		return invalid("watch_interval", "must be at least %v, got %v", MIN_WATCH_INTERVAL, yml.WatchInterval)
+	}
+	if err := validateLog(yml.Log); err != nil {
+		return err
+	}
+	if err := validateAdmin(yml.Admin); err != nil {
+		return err
+	}
+	if err := validateConnLimits(yml.Limits); err != nil {
+		return err
+	}
+	if yml.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(yml.MetricsAddress); err != nil {
+			return invalid("metrics_address", "expected host:port, got %q", yml.MetricsAddress)
+		}
+	}
+	return nil
+}
+
+// configSource tells where a config value comes from, so errors point
+// to the file line or to the flag or the variable.
+type configSource struct {
+	filename  string
+	data      []byte
+	overrides map[string]override
+}
+
+// wrap prefixes the error of the key with its location.
+func (src *configSource) wrap(err error) error {
+	keyErr, ok := err.(*keyError)
+	if !ok {
+		return fmt.Errorf("%s: %v", src.filename, err)
+	}
+
+	if o, ok := src.overrides[keyErr.key]; ok {
+		return fmt.Errorf("%s: %v", o.source, keyErr)
+	}
+	if line := src.line(keyErr.key); line > 0 {
+		return fmt.Errorf("%s:%d: %v", src.filename, line, keyErr)
+	}
+	return fmt.Errorf("%s: %v", src.filename, keyErr)
+}
+
+// line returns the line number of the key, 0 if it's not found.
+// Nested keys are dotted: log.level.
+func (src *configSource) line(key string) int {
+	lines := bytes.Split(src.data, []byte("\n"))
+	found, indent := -1, -1
+	for _, part := range strings.Split(key, ".") {
+		next := -1
+		for i := found + 1; i < len(lines); i++ {
+			trimmed := bytes.TrimLeft(lines[i], " ")
+			lineIndent := len(lines[i]) - len(trimmed)
+			if len(trimmed) == 0 || trimmed[0] == '#' {
+				continue
+			}
+			if found < 0 && lineIndent > 0 {
+				continue
+			}
+			if found >= 0 && lineIndent <= indent {
+				// the parent section is finished
+				break
+			}
+			if bytes.HasPrefix(trimmed, []byte(part)) && bytes.HasPrefix(bytes.TrimLeft(trimmed[len(part):], " \t"), []byte(":")) {
+				next, indent = i, lineIndent
+				break
+			}
+		}
+		if next < 0 {
+			return 0
+		}
+		found = next
+	}
+	return found + 1
+}
+
+var unknownFieldError = regexp.MustCompile(`^line (\d+): field (\S+) not found in type \S+$`)
+
+// decodeError makes yaml errors readable:
+// "line 3: field mtus not found in type main.ymlconfig" is
+// reported as "socks5.yaml:3: unknown key mtus".
+func (src *configSource) decodeError(err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return errors.New(src.locate(strings.TrimPrefix(err.Error(), "yaml: ")))
+	}
+
+	messages := make([]string, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		if m := unknownFieldError.FindStringSubmatch(msg); m != nil {
+			msg = "line " + m[1] + ": unknown key " + m[2]
+		}
+		messages = append(messages, src.locate(msg))
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// locate replaces "line N: " prefix of yaml message with "filename:N: ".
+func (src *configSource) locate(msg string) string {
+	if strings.HasPrefix(msg, "line ") {
+		return src.filename + ":" + strings.TrimPrefix(msg, "line ")
+	}
+	return src.filename + ": " + msg
+}
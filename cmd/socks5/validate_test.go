@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_loadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "socks5.yaml")
+
+	tests := []struct {
+		name      string
+		content   string
+		overrides map[string]override
+		wantErr   string
+	}{
+		{"empty file uses defaults", "", nil, ""},
+		{"valid", "port: 7788\nmtu: 1400\nidle_timeout: 5m\n", nil, ""},
+		{"zero mtu", "port: 7788\nmtu: 0\n", nil, filename + ":2: mtu: must be between 512 and 65535, got 0"},
+		{"unknown network", "network: udp\n", nil, filename + ":1: network: unsupported network"},
+		{"port out of range", "address: 0.0.0.0\n\nport: 70000\n", nil, filename + ":3: port: must be between 1 and 65535"},
+		{"unknown key", "port: 7788\nmtus: 1400\n", nil, filename + ":2: unknown key mtus"},
+		{"unknown nested key", "ruleset:\n  default: allow\n  rulez: []\n", nil, filename + ":3: unknown key rulez"},
+		{"syntax", "port: 7788\n  mtu: 1400\n", nil, filename + ":2: "},
+		{"wrong type", "port: http\n", nil, filename + ":1: cannot unmarshal"},
+		{"negative timeout", "idle_timeout: -1s\n", nil, filename + ":1: idle_timeout: must not be negative"},
+		{"pass without users", "auth: PASS\n", nil, filename + ":1: auth: PASS requires"},
+		{"ruleset", "ruleset:\n  default: maybe\n", nil, filename + ":1: ruleset: ruleset default"},
+		{"log level", "port: 7788\nlog:\n  output: stdout\n  level: verbose\n", nil, filename + ":4: log.level: unknown level"},
+		{"log output", "log:\n  output: kafka\n", nil, filename + ":2: log.output: unknown output"},
+		{"negative limit", "limits:\n  max_sessions_per_user: -1\n", nil, filename + ":2: limits.max_sessions_per_user: must not be negative"},
+		{"admin without token", "admin:\n  enabled: true\n  token: \"\"\n", nil, filename + ":3: admin.token: must not be empty"},
+		{"nested key is not top level", "ruleset:\n  default: allow\nmtu: 10\n", nil, filename + ":3: mtu:"},
+		{"override", "port: 7788\n", map[string]override{"port": {"0", "SOCKS5_PORT"}}, "SOCKS5_PORT: port: must be between"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(options{configFile: filename, overrides: tt.overrides})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("loadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_defaults(t *testing.T) {
+	cfg, err := loadConfig(options{configFile: "missing.yaml", configOptional: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Network != "tcp" || cfg.Server.Port != 1080 || cfg.Server.MTU != 1400 || cfg.Server.HandshakeTimeout != 30*time.Second {
+		t.Errorf("loadConfig() defaults got = %+v", cfg.Server)
+	}
+
+	if _, err := loadConfig(options{configFile: "missing.yaml"}); err == nil {
+		t.Error("loadConfig() of missing file given explicitly error = nil")
+	}
+}
+
+func Test_loadConfig_example(t *testing.T) {
+	if _, err := loadConfig(options{configFile: "../../socks5.yaml"}); err != nil {
+		t.Errorf("loadConfig() of the example config error = %v", err)
+	}
+}
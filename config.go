@@ -1,71 +1,43 @@
-package main
+package socks5
 
-import (
-	"fmt"
-	"gopkg.in/yaml.v2"
-	"os"
-	"strings"
-)
+import "time"
 
-type config struct {
+// Config holds server settings.
+type Config struct {
 	Network string
 	Address string
 	Port    int
 	Auth    AuthType
-	User    []byte
-	Pass    []byte
-	MTU     int
-}
-
-type ymlconfig struct {
-	Network string
-	Address string
-	Port    int
-	Auth    string
-	User    string
-	Pass    string
-	MTU     int
-}
-
-func tryParseConfig() (config, bool) {
-	cfgFile, err := os.OpenFile(configFilename, os.O_RDONLY, 0666)
-	if err != nil {
-		fmt.Printf("Unable to open config file %s: %s:", configFilename, err.Error())
-		return config{}, false
-	}
-
-	var ymlcfg ymlconfig
-	decoder := yaml.NewDecoder(cfgFile)
-	err = decoder.Decode(&ymlcfg)
-	if err != nil { // && err != io.EOF
-		fmt.Printf("Fail to parse config: %v", err)
-		return config{}, false
-	}
-
-	var auth AuthType
-	switch strings.ToUpper(ymlcfg.Auth) {
-	case "NO":
-		auth = NO_AUTH
-	case "PASS":
-		auth = PASS_AUTH
-		if ymlcfg.User == "" || ymlcfg.Pass == ""{
-			fmt.Printf("User or password not defined")
-			return config{}, false
-		}
-	default:
-		fmt.Printf("Unknown auth type")
-		return config{}, false
-	}
-
-	cfg := config{
-		Network: ymlcfg.Network,
-		Address: ymlcfg.Address,
-		Port:    ymlcfg.Port,
-		Auth:    auth,
-		User:    []byte(ymlcfg.User),
-		Pass:    []byte(ymlcfg.Pass),
-		MTU:     ymlcfg.MTU,
-	}
-
-	return cfg, true
+	// Credentials is used for PASS_AUTH
+	Credentials CredentialStore
+	MTU         int
+	// Router selects upstream proxies, nil dials directly
+	Router *Router
+	// Rules is evaluated before dialing, nil allows everything
+	Rules *RuleSet
+	// SOCKS4 accepts SOCKS4 and SOCKS4a CONNECT and BIND requests
+	// on the same port, they are rejected unless Auth is NO_AUTH
+	SOCKS4 bool
+
+	// Zero timeout means no limit.
+	// HandshakeTimeout limits negotiation, authentication and request.
+	HandshakeTimeout time.Duration
+	// ConnectTimeout limits outbound connection including upstream
+	// handshakes. For BIND it limits waiting for the inbound connection,
+	// BIND_ACCEPT_TIMEOUT is used if it's not set.
+	ConnectTimeout time.Duration
+	// IdleTimeout closes the session when no data is read in
+	// either direction, for UDP ASSOCIATE when no datagram is relayed.
+	IdleTimeout time.Duration
+	// MaxSessionLifetime closes the session regardless of activity.
+	MaxSessionLifetime time.Duration
+
+	// Bandwidth limits relayed TCP data, zero limits are unlimited
+	Bandwidth BandwidthLimits
+	Limits    ConnectionLimits
+	// AuthProtection delays and locks out failed authentications
+	AuthProtection AuthProtection
+	// Quotas accounts relayed bytes of users, nil disables quotas.
+	// The same Quotas is passed to Reload, so usage is not lost.
+	Quotas *Quotas
 }
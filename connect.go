@@ -1,12 +1,15 @@
-package main
+package socks5
 
 import (
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"math/rand"
 	"net"
+	"strconv"
+	"time"
 )
 
 // input positions
@@ -50,36 +53,171 @@ func NewRequest(conn net.Conn, proxy *proxy, logger *zap.Logger) *connect {
 	return &connect{conn: conn, proxy: proxy, logger: logger}
 }
 
+// Read reads VER, CMD, RSV, ATYP and the address,
+// its length depends on ATYP.
+func (state *connect) Read(r io.Reader) ([]byte, error) {
+	input, err := readBytes(r, nil, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	switch input[CON_ARG_ATYP] {
+	case ATYP_IPV4:
+		return readBytes(r, input, net.IPv4len+2)
+	case ATYP_IPV6:
+		return readBytes(r, input, net.IPv6len+2)
+	case ATYP_DOMAIN:
+		input, err = readBytes(r, input, 1)
+		if err != nil {
+			return nil, err
+		}
+		return readBytes(r, input, int(input[4])+2)
+	}
+
+	// unknown address type, rejected by validate
+	return input, nil
+}
+
 func (state *connect) Receive(input []byte) ([]byte, error) {
 	err := state.validate(input)
 	if err != nil {
-		return nil, err
+		rep := validationReply(input)
+		return state.failure(rep), replyError(rep, err)
 	}
 
-	addr, err := getAddr(input)
+	dst, err := getDestination(input)
 	if err != nil {
-		return nil, err
+		return state.failure(GENERAL_ERROR), replyError(GENERAL_ERROR, err)
+	}
+
+	// Domain is resolved by the upstream proxy if the connection goes through it.
+	cmd := input[CON_ARG_CMD]
+	defer func() {
+		// dst is resolved by now, unless it goes through the upstream
+		state.proxy.setRequest(state.request(cmd, dst))
+	}()
+	if user := state.proxy.authentication.username; state.proxy.cfg.Quotas.exhausted(user) {
+		state.logger.Warn(fmt.Sprintf("Rejected request of user %s: quota exceeded", user))
+		return state.failure(NOT_ALLOWED_BY_RULSET), fmt.Errorf("quota of user %s exceeded", user)
 	}
+	if !state.proxy.admitUser() {
+		user := state.proxy.authentication.username
+		state.logger.Warn(fmt.Sprintf("Rejected request of user %s: %s limit exceeded", user, REJECT_USER_LIMIT))
+		return state.failure(NOT_ALLOWED_BY_RULSET), fmt.Errorf("too many sessions of user %s", user)
+	}
+	var dialer Dialer
+	if cmd == CMD_CONNECT {
+		dialer = state.proxy.cfg.Router.Dialer(dst.domain, dst.ip)
+	}
+	if dialer == nil {
+		if err = dst.resolve(); err != nil {
+			rep := replyCode(err)
+			return state.failure(rep), replyError(rep, err)
+		}
+	}
+	addr := dst.dialAddr()
 
-	switch input[CON_ARG_CMD] {
+	req := state.request(cmd, dst)
+	if req.IP == nil && state.proxy.cfg.Rules.resolvesUpstream() {
+		// the upstream resolves the domain, it's resolved here too,
+		// so destination rules apply to it
+		resolved := *dst
+		if err := resolved.resolve(); err == nil {
+			req.IP = resolved.ip
+		}
+	}
+	allowed, rule := state.proxy.cfg.Rules.Evaluate(req)
+	if !allowed {
+		state.logger.Info(fmt.Sprintf("Denied by rule %s: %s", rule, req))
+		return state.failure(NOT_ALLOWED_BY_RULSET), errors.New("not allowed by ruleset")
+	}
+	state.logger.Info(fmt.Sprintf("Allowed by rule %s: %s", rule, req))
+
+	switch cmd {
 	case CMD_CONNECT:
-		conn, err := net.Dial("tcp", addr)
-		if err != nil {
-			// check cause by error message
-			return []byte{PROTOCOL_VERSION, SUCCESS, HOST_UNREACHABLE, 0x01}, err
+		route := "direct"
+		if dialer == nil {
+			dialer = &net.Dialer{}
+		} else {
+			route = fmt.Sprint(dialer)
+			state.logger.Info(fmt.Sprintf("Connect %s through upstream %v", addr, dialer))
 		}
 
-		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
-			state.proxy.output = conn
-			return state.response(PROTOCOL_VERSION, SUCCESS, ATYP_IPV4, addr.IP, intToByte(addr.Port)), nil
+		started := time.Now()
+		conn, err := dial(dialer, addr, state.proxy.cfg.ConnectTimeout)
+		state.proxy.metrics.dialed(route, started, err)
+		if err != nil {
+			rep := replyCode(err)
+			return state.failure(rep), replyError(rep, err)
 		}
+
+		state.proxy.output = conn
+		return state.success(conn.LocalAddr()), nil
 	case CMD_UDP:
-		return state.response(PROTOCOL_VERSION, COMMAND_NOT_SUPPORTED, ATYP_IPV4, []byte{}, []byte{}), nil
+		declared, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return state.failure(GENERAL_ERROR), replyError(GENERAL_ERROR, err)
+		}
+
+		relay, err := newUDPRelay(state.conn, declared, state.logger)
+		if err != nil {
+			return state.failure(GENERAL_ERROR), replyError(GENERAL_ERROR, err)
+		}
+
+		// every datagram destination is checked against the ruleset too
+		relay.allow = func(domain string, dst *net.UDPAddr) bool {
+			allowed, _ := state.proxy.cfg.Rules.Evaluate(state.request(CMD_UDP, &destination{domain: domain, ip: dst.IP, port: dst.Port}))
+			return allowed
+		}
+		relay.count = state.proxy.count
+		relay.idleTimeout = state.proxy.cfg.IdleTimeout
+
+		state.proxy.udp = relay
+		return state.success(relay.LocalAddr()), nil
 	case CMD_BIND:
-		return state.response(PROTOCOL_VERSION, COMMAND_NOT_SUPPORTED, ATYP_IPV4, []byte{}, []byte{}), nil
+		expected, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return state.failure(GENERAL_ERROR), replyError(GENERAL_ERROR, err)
+		}
+
+		bind, err := newBind(state.conn, expected, state.proxy.cfg.ConnectTimeout, state.logger)
+		if err != nil {
+			return state.failure(GENERAL_ERROR), replyError(GENERAL_ERROR, err)
+		}
+
+		state.proxy.bind = bind
+		return state.success(bind.Addr()), nil
+	}
+
+	return state.failure(COMMAND_NOT_SUPPORTED), errors.New(replyName(COMMAND_NOT_SUPPORTED))
+}
+
+// request describes the client request for the ruleset.
+func (state *connect) request(cmd byte, dst *destination) *Request {
+	req := &Request{
+		Command: cmd,
+		User:    state.proxy.authentication.username,
+		Domain:  dst.domain,
+		IP:      dst.ip,
+		Port:    dst.port,
+	}
+	if addr, ok := state.conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.Source = addr.IP
+	}
+	return req
+}
+
+// ReceiveBind waits for the inbound connection of a BIND request
+// and returns the second reply with the address of the connected peer.
+func (state *connect) ReceiveBind() ([]byte, error) {
+	conn, err := state.proxy.bind.Accept()
+	if err != nil {
+		rep := replyCode(err)
+		return state.failure(rep), replyError(rep, err)
 	}
 
-	return state.response(PROTOCOL_VERSION, COMMAND_NOT_SUPPORTED, ATYP_IPV4, []byte{}, []byte{}), nil
+	state.proxy.output = conn
+	return state.success(conn.RemoteAddr()), nil
 }
 
 func intToByte(port int) []byte {
@@ -88,6 +226,18 @@ func intToByte(port int) []byte {
 	return bndPort
 }
 
+// addrBytes returns address type and address in wire format: 4 bytes
+// for IPv4 (including IPv4-mapped IPv6) and 16 bytes for IPv6.
+func addrBytes(ip net.IP) (byte, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ATYP_IPV4, ip4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ATYP_IPV6, ip16
+	}
+	return ATYP_IPV4, net.IPv4zero.To4()
+}
+
 func (state *connect) response(protocol, status, atype byte, bndAddr, bndPort []byte) []byte {
 	r := []byte{protocol, status, 0x00, atype}
 	r = append(r, bndAddr...)
@@ -95,47 +245,119 @@ func (state *connect) response(protocol, status, atype byte, bndAddr, bndPort []
 	return r
 }
 
-func getAddr(input []byte) (string, error) {
+type destination struct {
+	// domain is empty if the client requested an IP address
+	domain string
+	ip     net.IP
+	port   int
+}
+
+func (d *destination) String() string {
+	return net.JoinHostPort(d.ip.String(), strconv.Itoa(d.port))
+}
+
+// dialAddr is the resolved address, or the domain if it's not resolved
+// locally and left to an upstream proxy.
+func (d *destination) dialAddr() string {
+	if d.ip == nil {
+		return net.JoinHostPort(d.domain, strconv.Itoa(d.port))
+	}
+	return d.String()
+}
+
+// resolve looks up IP address of the domain.
+func (d *destination) resolve() error {
+	if d.ip != nil {
+		return nil
+	}
+
+	addr, err := net.LookupHost(d.domain)
+	if err != nil {
+		return err
+	}
+	if len(addr) == 0 {
+		return errors.New("domain haven't ip address")
+	}
+	d.ip = net.ParseIP(addr[rand.Intn(len(addr))])
+	return nil
+}
+
+// success is a reply with BND.ADDR and BND.PORT of addr. ATYP follows
+// the real address family, unknown address is sent as 0.0.0.0:0.
+func (state *connect) success(addr net.Addr) []byte {
 	var ip net.IP
 	var port int
-	isIPv6 := false
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	atyp, bndAddr := addrBytes(ip)
+	return state.response(PROTOCOL_VERSION, SUCCESS, atyp, bndAddr, intToByte(port))
+}
+
+// failure is a reply with unspecified BND.ADDR and BND.PORT.
+func (state *connect) failure(status byte) []byte {
+	return state.response(PROTOCOL_VERSION, status, ATYP_IPV4, net.IPv4zero.To4(), intToByte(0))
+}
+
+// validationReply chooses REP code for a request rejected by validate.
+func validationReply(input []byte) byte {
+	if len(input) > CON_ARG_CMD {
+		cmd := input[CON_ARG_CMD]
+		if cmd != CMD_CONNECT && cmd != CMD_BIND && cmd != CMD_UDP {
+			return COMMAND_NOT_SUPPORTED
+		}
+	}
+	if len(input) > CON_ARG_ATYP {
+		atyp := input[CON_ARG_ATYP]
+		if atyp != ATYP_IPV4 && atyp != ATYP_IPV6 && atyp != ATYP_DOMAIN {
+			return ADDRESS_TYPE_NOT_SUPPORTED
+		}
+	}
+	return GENERAL_ERROR
+}
+
+func getAddr(input []byte) (string, error) {
+	dst, err := getDestination(input)
+	if err != nil {
+		return "", err
+	}
+	if err = dst.resolve(); err != nil {
+		return "", err
+	}
+	return dst.String(), nil
+}
+
+// getDestination parses DST.ADDR and DST.PORT, domain isn't resolved.
+func getDestination(input []byte) (*destination, error) {
+	dst := &destination{}
 
 	switch input[CON_ARG_ATYP] {
 	case ATYP_IPV4:
 		if len(input) < 10{
-			return "", errors.New("invalid address")
+			return nil, errors.New("invalid address")
 		}
-		ip = input[4:8]
-		port = int(binary.BigEndian.Uint16(input[8:10]))
+		dst.ip = input[4:8]
+		dst.port = int(binary.BigEndian.Uint16(input[8:10]))
 	case ATYP_IPV6:
 		if len(input) < 22{
-			return "", errors.New("invalid address")
+			return nil, errors.New("invalid address")
 		}
-		ip = input[4:20]
-		port = int(binary.BigEndian.Uint16(input[20:22]))
-		isIPv6 = true
+		dst.ip = input[4:20]
+		dst.port = int(binary.BigEndian.Uint16(input[20:22]))
 	case ATYP_DOMAIN:
 		domainLen := int(input[4])
-		if len(input) < 4 + domainLen{
-			return "", errors.New("invalid domain")
-		}
-		domain := string(input[5 : 5+domainLen])
-		addr, err := net.LookupHost(domain)
-		if err != nil {
-			return "", err
+		if len(input) < 7+domainLen {
+			return nil, errors.New("invalid domain")
 		}
-		if len(addr) == 0 {
-			return "", errors.New("domain haven't ip address")
-		}
-		ip = net.ParseIP(addr[rand.Intn(len(addr))])
-		port = int(binary.BigEndian.Uint16(input[5+domainLen : 7+domainLen]))
-		isIPv6 = ip.To4() == nil
+		dst.domain = string(input[5 : 5+domainLen])
+		dst.port = int(binary.BigEndian.Uint16(input[5+domainLen : 7+domainLen]))
 	}
 
-	if isIPv6 {
-		return fmt.Sprintf("[%v]:%v", ip.String(), port), nil
-	}
-	return fmt.Sprintf("%v:%v", ip.String(), port), nil
+	return dst, nil
 }
 
 func (state *connect) validate(input []byte) error {
@@ -1,13 +1,29 @@
-package main
+package socks5
 
 import (
+	"bytes"
 	"go.uber.org/zap"
 	"net"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func Test_connect_Receive(t *testing.T) {
+	// closed port for connection refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := intToByte(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	p := newProxy(server, Config{MTU: 1400}, zap.NewNop())
+	denyAll := newProxy(server, Config{MTU: 1400, Rules: &RuleSet{}}, zap.NewNop())
+
 	type fields struct {
 		MTU    int
 		conn   net.Conn
@@ -23,7 +39,26 @@ func Test_connect_Receive(t *testing.T) {
 		want    []byte
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{"connection refused",
+			fields{conn: server, logger: zap.NewNop(), proxy: p},
+			append([]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01}, closedPort...),
+			[]byte{PROTOCOL_VERSION, CONNECTION_REFUSED, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0},
+			true},
+		{"not allowed by ruleset",
+			fields{conn: server, logger: zap.NewNop(), proxy: denyAll},
+			append([]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01}, closedPort...),
+			[]byte{PROTOCOL_VERSION, NOT_ALLOWED_BY_RULSET, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0},
+			true},
+		{"command not supported",
+			fields{conn: server, logger: zap.NewNop(), proxy: p},
+			[]byte{PROTOCOL_VERSION, 0x04, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50},
+			[]byte{PROTOCOL_VERSION, COMMAND_NOT_SUPPORTED, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0},
+			true},
+		{"address type not supported",
+			fields{conn: server, logger: zap.NewNop(), proxy: p},
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, 0x05, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50},
+			[]byte{PROTOCOL_VERSION, ADDRESS_TYPE_NOT_SUPPORTED, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0},
+			true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -203,3 +238,127 @@ func Test_connect_validate(t *testing.T) {
 		})
 	}
 }
+
+func Test_connect_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"IPv4 with early data",
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4, 0xAA, 0xAA, 0xAA, 0xAA, 0x09, 0x10, 'G', 'E', 'T'},
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4, 0xAA, 0xAA, 0xAA, 0xAA, 0x09, 0x10},
+			false},
+		{"IPv6",
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV6,
+				0x4f, 0xfe, 0x29, 0x00, 0x55, 0x45, 0x32, 0x10, 0x20, 0x00, 0xf8, 0xff, 0xfe, 0x21, 0x67, 0xcf,
+				0x09, 0x10},
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV6,
+				0x4f, 0xfe, 0x29, 0x00, 0x55, 0x45, 0x32, 0x10, 0x20, 0x00, 0xf8, 0xff, 0xfe, 0x21, 0x67, 0xcf,
+				0x09, 0x10},
+			false},
+		{"domain with early data",
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_DOMAIN, 0x03, 'a', '.', 'b', 0x00, 0x50, 'G'},
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_DOMAIN, 0x03, 'a', '.', 'b', 0x00, 0x50},
+			false},
+		{"truncated IPv4",
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4, 0xAA, 0xAA, 0xAA},
+			nil,
+			true},
+		{"truncated domain",
+			[]byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_DOMAIN, 0x05, 'a', '.'},
+			nil,
+			true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &connect{}
+			got, err := state.Read(iotest.OneByteReader(bytes.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_connect_success(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want []byte
+	}{
+		{"IPv4",
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1080},
+			[]byte{PROTOCOL_VERSION, SUCCESS, 0x00, ATYP_IPV4, 192, 168, 0, 1, 0x04, 0x38}},
+		{"IPv4 as 4 bytes",
+			&net.TCPAddr{IP: net.IP{192, 168, 0, 1}, Port: 1080},
+			[]byte{PROTOCOL_VERSION, SUCCESS, 0x00, ATYP_IPV4, 192, 168, 0, 1, 0x04, 0x38}},
+		{"IPv6",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080},
+			[]byte{PROTOCOL_VERSION, SUCCESS, 0x00, ATYP_IPV6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x04, 0x38}},
+		{"UDP",
+			&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+			[]byte{PROTOCOL_VERSION, SUCCESS, 0x00, ATYP_IPV4, 127, 0, 0, 1, 0x00, 0x35}},
+		{"unknown",
+			&net.UnixAddr{Name: "/tmp/socks5.sock", Net: "unix"},
+			[]byte{PROTOCOL_VERSION, SUCCESS, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &connect{}
+			if got := state.success(tt.addr); !bytes.Equal(got, tt.want) {
+				t.Errorf("success() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_connect_Receive_upstreamRules(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	upstream := listenSOCKS5(t, Config{Auth: NO_AUTH, MTU: 1400})
+	defer upstream.Close()
+	router := &Router{Default: &Chain{Upstreams: []Upstream{{Type: UPSTREAM_SOCKS5, Address: upstream.Addr().String()}}}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	request := func(domain string) []byte {
+		input := []byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_DOMAIN, byte(len(domain))}
+		input = append(input, domain...)
+		return append(input, intToByte(echo.Addr().(*net.TCPAddr).Port)...)
+	}
+	deny := func(cidr string, resolve bool) *RuleSet {
+		return &RuleSet{Rules: []Rule{{Name: "deny", Destinations: []*net.IPNet{mustCIDR(cidr)}}}, DefaultAllow: true, ResolveUpstream: resolve}
+	}
+
+	tests := []struct {
+		name  string
+		rules *RuleSet
+		input []byte
+		want  byte
+	}{
+		{"resolved into denied network", deny("127.0.0.0/8", true), request("localhost"), NOT_ALLOWED_BY_RULSET},
+		{"unresolved domain", deny("127.0.0.0/8", true), request("unresolved.invalid"), NOT_ALLOWED_BY_RULSET},
+		{"resolved out of denied network", deny("10.0.0.0/8", true), request("localhost"), SUCCESS},
+		{"resolved by upstream only", deny("127.0.0.0/8", false), request("localhost"), SUCCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newProxy(server, Config{MTU: 1400, Router: router, Rules: tt.rules}, zap.NewNop())
+			got, _ := p.request.Receive(tt.input)
+			if p.output != nil {
+				p.output.Close()
+			}
+			if got[1] != tt.want {
+				t.Errorf("Receive() reply = %v, want %v", replyName(got[1]), replyName(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CredentialStore checks username/password pairs of RFC 1929 authentication.
+type CredentialStore interface {
+	Authenticate(user, pass []byte) bool
+}
+
+// Credentials maps username to its password. Password is stored either in
+// plain text or as a bcrypt ($2a$, $2b$, $2y$) or argon2 ($argon2i$,
+// $argon2id$) hash.
+type Credentials map[string]string
+
+// dummySecret is compared for unknown users,
+// so response time doesn't tell whether the user exists.
+const dummySecret = "$2a$10$9AAIucLqBP1khrXg/WF7t.CacrkhLtbaE.VZjYBRB7uhOEv19qVXi"
+
+func (c Credentials) Authenticate(user, pass []byte) bool {
+	secret, ok := c[string(user)]
+	if !ok {
+		verifyPassword(dummySecret, pass)
+		return false
+	}
+	return verifyPassword(secret, pass)
+}
+
+// Validate checks that every password is either plain text
+// or a hash of a supported scheme.
+func (c Credentials) Validate() error {
+	for user, secret := range c {
+		if user == "" {
+			return errors.New("empty username")
+		}
+		if err := validateSecret(secret); err != nil {
+			return fmt.Errorf("user %s: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// LoadHtpasswd reads htpasswd-style file: one "user:password" per line,
+// empty lines and lines starting with # are skipped.
+func LoadHtpasswd(filename string) (Credentials, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseHtpasswd(file)
+}
+
+func ParseHtpasswd(r io.Reader) (Credentials, error) {
+	credentials := Credentials{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		sep := strings.Index(text, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: invalid format, expected user:password", line)
+		}
+
+		user, secret := text[:sep], text[sep+1:]
+		if err := validateSecret(secret); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: %v", line, user, err)
+		}
+		if _, ok := credentials[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %s", line, user)
+		}
+		credentials[user] = secret
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func isBcrypt(secret string) bool {
+	return strings.HasPrefix(secret, "$2a$") || strings.HasPrefix(secret, "$2b$") || strings.HasPrefix(secret, "$2y$")
+}
+
+func isArgon2(secret string) bool {
+	return strings.HasPrefix(secret, "$argon2i$") || strings.HasPrefix(secret, "$argon2id$")
+}
+
+// validateSecret rejects hashes of unsupported schemes,
+// which would be compared as plain text otherwise.
+func validateSecret(secret string) error {
+	switch {
+	case secret == "":
+		return errors.New("empty password")
+	case isBcrypt(secret):
+		_, err := bcrypt.Cost([]byte(secret))
+		return err
+	case isArgon2(secret):
+		_, err := parseArgon2(secret)
+		return err
+	case strings.HasPrefix(secret, "$"), strings.HasPrefix(secret, "{SHA}"):
+		return errors.New("unsupported password hash")
+	}
+	return nil
+}
+
+func verifyPassword(secret string, pass []byte) bool {
+	switch {
+	case isBcrypt(secret):
+		return bcrypt.CompareHashAndPassword([]byte(secret), pass) == nil
+	case isArgon2(secret):
+		hash, err := parseArgon2(secret)
+		if err != nil {
+			return false
+		}
+		return hash.verify(pass)
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), pass) == 1
+}
+
+// ARGON2_MAX_MEMORY caps m of argon2 hashes in KiB, a larger one would
+// allocate that much on every login.
+const ARGON2_MAX_MEMORY = 1 << 20
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 parses PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func parseArgon2(secret string) (*argon2Hash, error) {
+	parts := strings.Split(secret, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2 hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, errors.New("invalid argon2 version")
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	hash := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads); err != nil {
+		return nil, errors.New("invalid argon2 parameters")
+	}
+	// argon2 panics on zero time or threads
+	if hash.time < 1 || hash.threads < 1 {
+		return nil, errors.New("invalid argon2 parameters: t and p must be at least 1")
+	}
+	if hash.memory > ARGON2_MAX_MEMORY {
+		return nil, fmt.Errorf("invalid argon2 parameters: m must be at most %d", ARGON2_MAX_MEMORY)
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("invalid argon2 salt")
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 {
+		return nil, errors.New("invalid argon2 key")
+	}
+	return hash, nil
+}
+
+func (h *argon2Hash) verify(pass []byte) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey(pass, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key(pass, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
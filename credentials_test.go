@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func argon2idSecret(pass string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pass), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s",
+		argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestCredentials_Authenticate(t *testing.T) {
+	bcryptSecret, err := bcrypt.GenerateFromPassword([]byte("bcrypt pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := Credentials{
+		"plain":  "plain pass",
+		"bcrypt": string(bcryptSecret),
+		"argon2": argon2idSecret("argon2 pass"),
+	}
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+		want bool
+	}{
+		{"plain", "plain", "plain pass", true},
+		{"plain wrong password", "plain", "plain pas", false},
+		{"bcrypt", "bcrypt", "bcrypt pass", true},
+		{"bcrypt wrong password", "bcrypt", "plain pass", false},
+		{"argon2", "argon2", "argon2 pass", true},
+		{"argon2 wrong password", "argon2", "argon2", false},
+		{"unknown user", "unknown", "plain pass", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := credentials.Authenticate([]byte(tt.user), []byte(tt.pass)); got != tt.want {
+				t.Errorf("Authenticate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{"valid", "# comment\n\nalice:$2y$05$Gd2BxOIVMr5DxpHODg2OKOJv8WKJMgCd1tVSE4b3kkhq8lxK6qRMu\nbob:" + argon2idSecret("pass") + "\n", 2, false},
+		{"plain", "alice:secret", 1, false},
+		{"unsupported hash", "alice:$apr1$salt$hash", 0, true},
+		{"sha hash", "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", 0, true},
+		{"invalid argon2", "alice:$argon2id$v=19$m=1024$salt", 0, true},
+		{"argon2 zero time", "alice:" + strings.Replace(argon2idSecret("pass"), "t=1", "t=0", 1), 0, true},
+		{"argon2 zero threads", "alice:" + strings.Replace(argon2idSecret("pass"), "p=1", "p=0", 1), 0, true},
+		{"argon2 huge memory", "alice:" + strings.Replace(argon2idSecret("pass"), "m=1024", "m=4294967295", 1), 0, true},
+		{"without password", "alice", 0, true},
+		{"empty password", "alice:", 0, true},
+		{"duplicate", "alice:a\nalice:b", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHtpasswd(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHtpasswd() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("ParseHtpasswd() got %v users, want %v", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Dialer opens outbound connections, *net.Dialer is used for direct ones.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer is implemented by dialers which support cancellation,
+// like *net.Dialer and *Chain.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dial connects through dialer, the timeout is applied if it's positive.
+func dial(dialer Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	contextDialer, ok := dialer.(ContextDialer)
+	if timeout <= 0 || !ok {
+		return dialer.Dial("tcp", addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return contextDialer.DialContext(ctx, "tcp", addr)
+}
+
+const (
+	UPSTREAM_SOCKS5 = "socks5"
+	UPSTREAM_HTTP   = "http"
+)
+
+// Upstream is a parent proxy.
+type Upstream struct {
+	// Type is UPSTREAM_SOCKS5 or UPSTREAM_HTTP
+	Type    string
+	Address string
+	User    string
+	Pass    string
+}
+
+// Chain dials through upstream proxies in sequence: the first one is dialed
+// directly, each next one is reached through the previous.
+type Chain struct {
+	Name      string
+	Upstreams []Upstream
+	// Dialer reaches the first upstream, nil means net.Dialer
+	Dialer Dialer
+}
+
+func (c *Chain) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext applies ctx deadline to upstream handshakes too.
+func (c *Chain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, errors.New("empty upstream chain")
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("network %s is not supported by upstream", network)
+	}
+
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	var conn net.Conn
+	var err error
+	if contextDialer, ok := dialer.(ContextDialer); ok {
+		conn, err = contextDialer.DialContext(ctx, "tcp", c.Upstreams[0].Address)
+	} else {
+		conn, err = dialer.Dial("tcp", c.Upstreams[0].Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	for i, upstream := range c.Upstreams {
+		target := addr
+		if i+1 < len(c.Upstreams) {
+			target = c.Upstreams[i+1].Address
+		}
+
+		if err = upstream.connect(conn, target); err != nil {
+			conn.Close()
+			if _, ok := err.(*UpstreamError); ok {
+				return nil, err
+			}
+			return nil, &UpstreamError{Upstream: upstream.Address, Reply: replyCode(err), Msg: err.Error()}
+		}
+	}
+	return conn, nil
+}
+
+func (c *Chain) String() string {
+	return c.Name
+}
+
+func (u *Upstream) connect(conn net.Conn, addr string) error {
+	switch u.Type {
+	case UPSTREAM_SOCKS5:
+		return u.connectSOCKS5(conn, addr)
+	case UPSTREAM_HTTP:
+		return u.connectHTTP(conn, addr)
+	}
+	return fmt.Errorf("unknown upstream type %s", u.Type)
+}
+
+func (u *Upstream) connectSOCKS5(conn net.Conn, addr string) error {
+	request, err := connectRequest(addr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(NO_AUTH)
+	if u.User != "" {
+		method = byte(PASS_AUTH)
+	}
+	if _, err := conn.Write([]byte{PROTOCOL_VERSION, 0x01, method}); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != PROTOCOL_VERSION || resp[1] != method {
+		return errors.New("authentication method not accepted")
+	}
+
+	if method == byte(PASS_AUTH) {
+		auth := []byte{PASS_AUTH_VERSION, byte(len(u.User))}
+		auth = append(auth, u.User...)
+		auth = append(auth, byte(len(u.Pass)))
+		auth = append(auth, u.Pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != PASS_AUTH_SUCCESS {
+			return errors.New("authentication failed")
+		}
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := &connect{}
+	input, err := reply.Read(conn)
+	if err != nil {
+		return err
+	}
+	if input[1] != SUCCESS {
+		return &UpstreamError{Upstream: u.Address, Reply: input[1], Msg: "connect failed: " + replyName(input[1])}
+	}
+	return nil
+}
+
+// connectRequest builds SOCKS5 CONNECT request for host:port.
+func connectRequest(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	request := []byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		atyp, ipBytes := addrBytes(ip)
+		request = append(request, atyp)
+		request = append(request, ipBytes...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("domain is too long")
+		}
+		request = append(request, ATYP_DOMAIN, byte(len(host)))
+		request = append(request, host...)
+	}
+
+	return append(request, intToByte(port)...), nil
+}
+
+const maxHTTPHeader = 8192
+
+func (u *Upstream) connectHTTP(conn net.Conn, addr string) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User + ":" + u.Pass))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		return err
+	}
+
+	// Header is read byte by byte, bytes after it belong to the tunnel.
+	header := make([]byte, 0, 512)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxHTTPHeader {
+			return errors.New("response header is too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &UpstreamError{Upstream: u.Address, Reply: httpReplyCode(resp.StatusCode), Msg: "connect failed with status " + resp.Status}
+	}
+	return nil
+}
+
+// Route sends matched destinations through Dialer.
+type Route struct {
+	Domains      []string
+	Destinations []*net.IPNet
+	// Dialer is nil for direct connection
+	Dialer Dialer
+}
+
+// Router selects the outbound dialer by destination, the first matched
+// route wins.
+type Router struct {
+	Routes []Route
+	// Default is used when no route matches, nil means direct connection
+	Default Dialer
+}
+
+// Dialer returns nil for direct connection. ip is nil for not resolved domain.
+func (r *Router) Dialer(domain string, ip net.IP) Dialer {
+	if r == nil {
+		return nil
+	}
+	for _, route := range r.Routes {
+		if matchDomain(route.Domains, domain) || containsIP(route.Destinations, ip) {
+			return route.Dialer
+		}
+	}
+	return r.Default
+}
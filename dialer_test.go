@@ -0,0 +1,162 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// listenEcho starts TCP echo server.
+func listenEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// listenHTTPConnect starts HTTP CONNECT proxy which requires user:pass.
+func listenHTTPConnect(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if user, pass, ok := parseProxyAuthorization(req); !ok || user != "user" || pass != "pass" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener
+}
+
+func parseProxyAuthorization(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+func listenSOCKS5(t *testing.T, cfg Config) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(cfg, nil).Serve(listener)
+	return listener
+}
+
+func TestChain_Dial(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	httpProxy := listenHTTPConnect(t)
+	defer httpProxy.Close()
+	socksProxy := listenSOCKS5(t, Config{Auth: PASS_AUTH, Credentials: Credentials{"user": "pass"}, MTU: 1400})
+	defer socksProxy.Close()
+
+	tests := []struct {
+		name      string
+		upstreams []Upstream
+		wantErr   bool
+	}{
+		{"socks5", []Upstream{{Type: UPSTREAM_SOCKS5, Address: socksProxy.Addr().String(), User: "user", Pass: "pass"}}, false},
+		{"http", []Upstream{{Type: UPSTREAM_HTTP, Address: httpProxy.Addr().String(), User: "user", Pass: "pass"}}, false},
+		{"http then socks5", []Upstream{
+			{Type: UPSTREAM_HTTP, Address: httpProxy.Addr().String(), User: "user", Pass: "pass"},
+			{Type: UPSTREAM_SOCKS5, Address: socksProxy.Addr().String(), User: "user", Pass: "pass"},
+		}, false},
+		{"socks5 wrong password", []Upstream{{Type: UPSTREAM_SOCKS5, Address: socksProxy.Addr().String(), User: "user", Pass: "wrong"}}, true},
+		{"http wrong password", []Upstream{{Type: UPSTREAM_HTTP, Address: httpProxy.Addr().String(), User: "user", Pass: "wrong"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &Chain{Upstreams: tt.upstreams}
+			conn, err := chain.Dial("tcp", echo.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("echo got = %q", got)
+			}
+		})
+	}
+}
+
+func TestRouter_Dialer(t *testing.T) {
+	corp := &Chain{Name: "corp"}
+	router := &Router{
+		Routes: []Route{
+			{Domains: []string{"direct.corp.example.com"}},
+			{Domains: []string{"*.corp.example.com"}, Destinations: []*net.IPNet{mustCIDR("10.0.0.0/8")}, Dialer: corp},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		router *Router
+		domain string
+		ip     net.IP
+		want   Dialer
+	}{
+		{"nil router", nil, "a.corp.example.com", nil, nil},
+		{"domain", router, "a.corp.example.com", nil, corp},
+		{"direct exception", router, "direct.corp.example.com", nil, nil},
+		{"cidr", router, "", net.IPv4(10, 0, 0, 1), corp},
+		{"default", router, "example.com", net.IPv4(1, 1, 1, 1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.router.Dialer(tt.domain, tt.ip); got != tt.want {
+				t.Errorf("Dialer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
-module socks5
+module github.com/NeekUP/socks5
 
-go 1.12
+go 1.13
 
 require (
+	github.com/prometheus/client_golang v1.5.1
 	go.uber.org/zap v1.14.0
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.2.8
 )
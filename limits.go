@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Rejection reasons of Metrics and logs.
+const (
+	REJECT_ACCEPT_RATE  = "accept_rate"
+	REJECT_MAX_SESSIONS = "max_sessions"
+	REJECT_CLIENT_LIMIT = "client_limit"
+	REJECT_USER_LIMIT   = "user_limit"
+)
+
+// ConnectionLimits bound the number of sessions, zero is unlimited.
+// Connections over the accept rate, MaxSessions or MaxSessionsPerClient
+// are closed before negotiation, requests of a user over
+// MaxSessionsPerUser are replied NOT_ALLOWED_BY_RULSET.
+type ConnectionLimits struct {
+	MaxSessions int
+	// MaxSessionsPerClient limits sessions from a client IP
+	MaxSessionsPerClient int
+	// MaxSessionsPerUser limits sessions of an authenticated user
+	MaxSessionsPerUser int
+	// AcceptRate limits new connections, Rate is connections per second
+	AcceptRate RateLimit
+}
+
+// sessionCounts counts sessions of a server for ConnectionLimits.
+// Sessions without a server have nil sessionCounts, users are not
+// limited then.
+type sessionCounts struct {
+	mu      sync.Mutex
+	total   int
+	clients map[string]int
+	users   map[string]int
+	accepts *bucket
+}
+
+// admit counts a new connection from the client IP, it returns
+// the rejection reason if the connection exceeds limits.
+func (c *sessionCounts) admit(client string, limits ConnectionLimits) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if limits.AcceptRate.Rate > 0 {
+		if c.accepts == nil {
+			c.accepts = newBucket(limits.AcceptRate)
+		} else {
+			c.accepts.setLimit(limits.AcceptRate)
+		}
+		if !c.accepts.allow(1, time.Now()) {
+			return REJECT_ACCEPT_RATE
+		}
+	}
+	if limits.MaxSessions > 0 && c.total >= limits.MaxSessions {
+		return REJECT_MAX_SESSIONS
+	}
+	if limits.MaxSessionsPerClient > 0 && c.clients[client] >= limits.MaxSessionsPerClient {
+		return REJECT_CLIENT_LIMIT
+	}
+
+	if c.clients == nil {
+		c.clients = make(map[string]int)
+	}
+	c.total++
+	c.clients[client]++
+	return ""
+}
+
+// release uncounts the finished session of the client IP.
+func (c *sessionCounts) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if c.clients[client]--; c.clients[client] <= 0 {
+		delete(c.clients, client)
+	}
+}
+
+// admitUser counts a session of the user, it reports false
+// if the user has max sessions already.
+func (c *sessionCounts) admitUser(user string, max int) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.users[user] >= max {
+		return false
+	}
+	if c.users == nil {
+		c.users = make(map[string]int)
+	}
+	c.users[user]++
+	return true
+}
+
+func (c *sessionCounts) releaseUser(user string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users[user]--; c.users[user] <= 0 {
+		delete(c.users, user)
+	}
+}
+
+// clientIP returns the IP of the address, or the address itself
+// if it's not TCP.
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
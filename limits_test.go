@@ -0,0 +1,88 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_sessionCounts_admit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ConnectionLimits
+		clients []string
+		want    []string
+	}{
+		{"unlimited", ConnectionLimits{}, []string{"a", "a", "b"}, []string{"", "", ""}},
+		{"max sessions", ConnectionLimits{MaxSessions: 2}, []string{"a", "b", "c"}, []string{"", "", REJECT_MAX_SESSIONS}},
+		{"per client", ConnectionLimits{MaxSessionsPerClient: 1}, []string{"a", "a", "b"}, []string{"", REJECT_CLIENT_LIMIT, ""}},
+		{"accept rate", ConnectionLimits{AcceptRate: RateLimit{Rate: 1, Burst: 2}}, []string{"a", "b", "c"}, []string{"", "", REJECT_ACCEPT_RATE}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := &sessionCounts{}
+			for i, client := range tt.clients {
+				if got := counts.admit(client, tt.limits); got != tt.want[i] {
+					t.Errorf("admit(%s) #%d got = %q, want %q", client, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	counts := &sessionCounts{}
+	limits := ConnectionLimits{MaxSessionsPerClient: 1}
+	counts.admit("a", limits)
+	counts.release("a")
+	if got := counts.admit("a", limits); got != "" {
+		t.Errorf("admit() after release got = %q", got)
+	}
+}
+
+func TestServer_limits(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	cfg := Config{
+		Auth:        PASS_AUTH,
+		Credentials: Credentials{"alice": "secret"},
+		MTU:         1400,
+		Limits:      ConnectionLimits{MaxSessionsPerClient: 2, MaxSessionsPerUser: 1},
+	}
+	server := NewServer(cfg, nil)
+	listener := listenServer(t, server)
+	defer listener.Close()
+	defer server.Close()
+
+	connect := func() (net.Conn, []byte) {
+		conn, _, reply := handshake(t, listener.Addr().String(), "alice", "secret", echo.Addr().(*net.TCPAddr))
+		return conn, reply
+	}
+
+	first, reply := connect()
+	defer first.Close()
+	if reply == nil || reply[1] != SUCCESS {
+		t.Fatalf("first reply got = %v", reply)
+	}
+
+	second, reply := connect()
+	defer second.Close()
+	if reply == nil || reply[1] != NOT_ALLOWED_BY_RULSET {
+		t.Errorf("reply over user limit got = %v, want %v", reply, NOT_ALLOWED_BY_RULSET)
+	}
+
+	// the second session may be still open, wait for it to finish
+	for i := 0; server.ActiveSessions() > 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the handshake holds a slot too
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	third, reply := connect()
+	defer third.Close()
+	if reply != nil {
+		t.Errorf("reply over client limit got = %v, want closed connection", reply)
+	}
+}
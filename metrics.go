@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Handshake stages of Metrics.
+const (
+	STAGE_NEGOTIATION    = "negotiation"
+	STAGE_AUTHENTICATION = "passwordAuthentication"
+	STAGE_CONNECT        = "connect"
+)
+
+// Handshake results of Metrics.
+const (
+	RESULT_SUCCESS = "success"
+	RESULT_FAILURE = "failure"
+	// RESULT_ERROR is a read error or a timeout before the message is received
+	RESULT_ERROR = "error"
+)
+
+// Relay directions of Metrics.
+const (
+	DIRECTION_UPLOAD   = "upload"
+	DIRECTION_DOWNLOAD = "download"
+)
+
+// Metrics collects Prometheus metrics of a Server. Nil Metrics
+// collects nothing.
+type Metrics struct {
+	connections    prometheus.Counter
+	activeSessions prometheus.Gauge
+	handshakes     *prometheus.CounterVec
+	authFailures   prometheus.Counter
+	replies        *prometheus.CounterVec
+	dialDuration   *prometheus.HistogramVec
+	relayedBytes   *prometheus.CounterVec
+	throttleWait   *prometheus.CounterVec
+	throttled      *prometheus.GaugeVec
+	rejected       *prometheus.CounterVec
+	lockouts       *prometheus.CounterVec
+}
+
+// NewMetrics creates metrics and registers them in registerer.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "socks5_connections_total",
+			Help: "Accepted client connections.",
+		}),
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "socks5_active_sessions",
+			Help: "Sessions being served.",
+		}),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_handshakes_total",
+			Help: "Handshake messages by stage and result.",
+		}, []string{"stage", "result"}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "socks5_auth_failures_total",
+			Help: "Failed username/password authentications.",
+		}),
+		replies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_replies_total",
+			Help: "Replies to requests by command and reply code.",
+		}, []string{"command", "reply"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "socks5_dial_duration_seconds",
+			Help:    "Outbound connection time including upstream handshakes.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"route", "result"}),
+		relayedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_relayed_bytes_total",
+			Help: "Bytes relayed by direction, user is empty without authentication.",
+		}, []string{"direction", "user"}),
+		throttleWait: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_throttle_wait_seconds_total",
+			Help: "Relay time spent waiting for bandwidth limits by direction and the most restrictive limit scope.",
+		}, []string{"direction", "scope"}),
+		throttled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "socks5_throttled_sessions",
+			Help: "Sessions waiting for bandwidth limits by direction.",
+		}, []string{"direction"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_rejected_connections_total",
+			Help: "Connections and requests rejected by connection limits by reason.",
+		}, []string{"reason"}),
+		lockouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_auth_lockouts_total",
+			Help: "Authentication lockouts of client IPs and usernames by scope.",
+		}, []string{"scope"}),
+	}
+
+	collectors := []prometheus.Collector{m.connections, m.activeSessions, m.handshakes, m.authFailures, m.replies, m.dialDuration, m.relayedBytes, m.throttleWait, m.throttled, m.rejected, m.lockouts}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) connectionAccepted() {
+	if m != nil {
+		m.connections.Inc()
+	}
+}
+
+func (m *Metrics) sessionStarted() {
+	if m != nil {
+		m.activeSessions.Inc()
+	}
+}
+
+func (m *Metrics) sessionFinished() {
+	if m != nil {
+		m.activeSessions.Dec()
+	}
+}
+
+func (m *Metrics) handshake(stage string, result string) {
+	if m == nil {
+		return
+	}
+	m.handshakes.WithLabelValues(stage, result).Inc()
+	if stage == STAGE_AUTHENTICATION && result == RESULT_FAILURE {
+		m.authFailures.Inc()
+	}
+}
+
+func (m *Metrics) reply(cmd byte, rep byte) {
+	if m != nil {
+		m.replies.WithLabelValues(commandName(cmd), replyName(rep)).Inc()
+	}
+}
+
+func (m *Metrics) dialed(route string, started time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := RESULT_SUCCESS
+	if err != nil {
+		result = RESULT_FAILURE
+	}
+	m.dialDuration.WithLabelValues(route, result).Observe(time.Since(started).Seconds())
+}
+
+func (m *Metrics) relayed(direction string, user string, n int64) {
+	if m != nil && n > 0 {
+		m.relayedBytes.WithLabelValues(direction, user).Add(float64(n))
+	}
+}
+
+func (m *Metrics) throttleStarted(direction string, scope string, delay time.Duration) {
+	if m != nil {
+		m.throttleWait.WithLabelValues(direction, scope).Add(delay.Seconds())
+		m.throttled.WithLabelValues(direction).Inc()
+	}
+}
+
+func (m *Metrics) throttleFinished(direction string) {
+	if m != nil {
+		m.throttled.WithLabelValues(direction).Dec()
+	}
+}
+
+func (m *Metrics) connectionRejected(reason string) {
+	if m != nil {
+		m.rejected.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *Metrics) lockout(scope string) {
+	if m != nil {
+		m.lockouts.WithLabelValues(scope).Inc()
+	}
+}
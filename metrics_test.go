@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	metrics, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(Config{Auth: PASS_AUTH, Credentials: Credentials{"alice": "secret"}, MTU: 1400}, nil)
+	server.Metrics = metrics
+	listener := listenServer(t, server)
+	defer listener.Close()
+
+	failed, _, _ := handshake(t, listener.Addr().String(), "alice", "wrong", nil)
+	failed.Close()
+
+	conn, _, reply := handshake(t, listener.Addr().String(), "alice", "secret", echo.Addr().(*net.TCPAddr))
+	if reply == nil || reply[1] != SUCCESS {
+		t.Fatalf("connect reply got = %v", reply)
+	}
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{"connections", metrics.connections, 2},
+		{"active sessions", metrics.activeSessions, 0},
+		{"auth failures", metrics.authFailures, 1},
+		{"negotiation", metrics.handshakes.WithLabelValues(STAGE_NEGOTIATION, RESULT_SUCCESS), 2},
+		{"authentication", metrics.handshakes.WithLabelValues(STAGE_AUTHENTICATION, RESULT_SUCCESS), 1},
+		{"connect", metrics.handshakes.WithLabelValues(STAGE_CONNECT, RESULT_SUCCESS), 1},
+		{"reply", metrics.replies.WithLabelValues("connect", replyName(SUCCESS)), 1},
+		{"upload", metrics.relayedBytes.WithLabelValues(DIRECTION_UPLOAD, "alice"), 4},
+		{"download", metrics.relayedBytes.WithLabelValues(DIRECTION_DOWNLOAD, "alice"), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tt.collector); got != tt.want {
+				t.Errorf("%s got = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	if got := testutil.CollectAndCount(metrics.dialDuration); got != 1 {
+		t.Errorf("dial duration series got = %v, want 1", got)
+	}
+}
+
+func TestNewMetrics_registered(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, err := NewMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMetrics(registry); err == nil {
+		t.Error("NewMetrics() registered metrics twice")
+	}
+}
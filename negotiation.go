@@ -1,7 +1,8 @@
-package main
+package socks5
 
 import (
 	"errors"
+	"io"
 )
 
 // input positions
@@ -18,6 +19,15 @@ func NewNegotiation(authType AuthType) *negotiation {
 	return &negotiation{authType: authType}
 }
 
+// Read reads VER, NMETHODS and NMETHODS bytes of METHODS.
+func (state *negotiation) Read(r io.Reader) ([]byte, error) {
+	input, err := readBytes(r, nil, 2)
+	if err != nil {
+		return nil, err
+	}
+	return readBytes(r, input, int(input[NEG_ARG_NMETHODS]))
+}
+
 func (state *negotiation) Receive(input []byte) ([]byte, error) {
 
 	err := state.validate(input)
@@ -1,8 +1,10 @@
-package main
+package socks5
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func Test_negotiation_Receive(t *testing.T) {
@@ -65,3 +67,35 @@ func Test_negotiation_validate(t *testing.T) {
 		})
 	}
 }
+
+func Test_negotiation_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"single method", []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}, []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}, false},
+		{"multiple methods", []byte{PROTOCOL_VERSION, 0x02, byte(NO_AUTH), byte(PASS_AUTH)}, []byte{PROTOCOL_VERSION, 0x02, byte(NO_AUTH), byte(PASS_AUTH)}, false},
+		{"pipelined", []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH), PROTOCOL_VERSION, CMD_CONNECT}, []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}, false},
+		{"truncated methods", []byte{PROTOCOL_VERSION, 0x02, byte(NO_AUTH)}, nil, true},
+		{"only version", []byte{PROTOCOL_VERSION}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &negotiation{}
+			r := bytes.NewReader(tt.input)
+			got, err := state.Read(iotest.OneByteReader(r))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() got = %v, want %v", got, tt.want)
+			}
+			if !tt.wantErr && r.Len() != len(tt.input)-len(tt.want) {
+				t.Errorf("Read() consumed %v bytes, want %v", len(tt.input)-r.Len(), len(tt.want))
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
-package main
+package socks5
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -13,51 +18,133 @@ const (
 )
 
 type state interface {
+	// Read reads exactly one message of the state, bytes sent after
+	// the message are left in r.
+	Read(r io.Reader) ([]byte, error)
 	Receive(input []byte) ([]byte, error)
 }
 
 type proxy struct {
+	id             string
 	state          state
 	input          net.Conn
+	reader         *bufio.Reader
 	output         net.Conn
-	cfg            config
+	udp            *udpRelay
+	bind           *bind
+	cfg            Config
 	log            *zap.Logger
+	metrics        *Metrics
+	accessLog      *zap.Logger
+	buckets        *buckets
+	counts         *sessionCounts
+	guard          *authGuard
 	negotiation    *negotiation
 	authentication *passwordAuthentication
 	request        *connect
-}
+	socks4         *socks4Request
+
+	started time.Time
+	// lastActivity is unix nano time of the last relayed read
+	lastActivity int64
+	// uploaded and downloaded are relayed bytes, updated atomically
+	uploaded   int64
+	downloaded int64
 
-func Start(conn net.Conn, cfg config, logger *zap.Logger) {
-	p := newProxy(conn, cfg, logger)
-	p.Run()
+	inputOnce  sync.Once
+	outputOnce sync.Once
+	// done is closed with the input connection
+	done chan struct{}
+
+	mu          sync.Mutex
+	closeReason string
+	closed      bool
+	// accepting is the BIND listener waiting for the inbound connection
+	accepting *bind
+	// req is the client request, nil before it's parsed
+	req     *Request
+	reply   byte
+	replied bool
+	// countedUser is the user counted for MaxSessionsPerUser
+	countedUser string
 }
 
-func newProxy(conn net.Conn, cfg config, logger *zap.Logger) *proxy {
+func newProxy(conn net.Conn, cfg Config, logger *zap.Logger) *proxy {
+	id := newSessionID()
+	logger = logger.With(zap.String("session", id))
 	proxy := &proxy{
+		id:             id,
 		input:          conn,
+		reader:         bufio.NewReaderSize(conn, cfg.MTU),
 		log:            logger,
 		cfg:            cfg,
+		started:        time.Now(),
+		done:           make(chan struct{}),
 		negotiation:    NewNegotiation(cfg.Auth),
-		authentication: NewPasswordAuthentication(cfg.User, cfg.Pass),
+		authentication: NewPasswordAuthentication(cfg.Credentials),
 	}
 
+	proxy.authentication.attempts = proxy
 	proxy.request = NewRequest( conn, proxy, logger)
+	if cfg.SOCKS4 {
+		proxy.socks4 = newSocks4Request(proxy)
+	}
 	proxy.state = proxy.negotiation
 	return proxy
 }
 
 func (p *proxy) Run() {
-	defer p.input.Close()
+	defer p.logAccess()
+	defer p.releaseUser()
+	defer p.closeInput()
+	p.metrics.sessionStarted()
+	defer p.metrics.sessionFinished()
+
+	if p.cfg.HandshakeTimeout > 0 {
+		p.input.SetDeadline(p.started.Add(p.cfg.HandshakeTimeout))
+	}
+
+	// SOCKS4 request comes without negotiation, read errors
+	// are handled by the first Read
+	if version, err := p.reader.Peek(1); err == nil && version[0] == SOCKS4_VERSION && p.socks4 != nil {
+		p.state = p.socks4
+	}
 
-	buff := make([]byte, p.cfg.MTU)
 	for {
-		n, err := p.input.Read(buff)
+		stage := p.stage()
+		input, err := p.state.Read(p.reader)
 		if err != nil {
+			p.metrics.handshake(stage, RESULT_ERROR)
+			if isTimeout(err) {
+				p.setCloseReason("handshake timeout")
+				p.log.Info(fmt.Sprintf("Session %v closed: handshake timeout", p.input.RemoteAddr().String()))
+				return
+			}
+			if reason := p.reason(); reason != "" {
+				p.log.Info(fmt.Sprintf("Session %v closed: %s", p.input.RemoteAddr().String(), reason))
+				return
+			}
+			if err == io.EOF {
+				p.setCloseReason("closed by client")
+			} else {
+				p.setCloseReason(fmt.Sprintf("handshake error: %v", err))
+			}
 			p.log.Error(fmt.Sprintf("Error read from %v: %v",p.input.RemoteAddr().String(),  err.Error()) )
 			return
 		}
 
-		resp, err := p.state.Receive(buff[:n])
+		resp, err := p.state.Receive(input)
+		p.metrics.handshake(stage, handshakeResult(p.state, resp, err))
+		switch s := p.state.(type) {
+		case *connect:
+			if resp != nil {
+				p.metrics.reply(input[CON_ARG_CMD], resp[1])
+				p.setReply(resp[1])
+			}
+		case *socks4Request:
+			p.metrics.reply(input[S4_ARG_CMD], s.rep)
+			p.setReply(s.rep)
+		}
 
 		if err != nil {
 			p.protocolError(resp, err)
@@ -72,6 +159,7 @@ func (p *proxy) Run() {
 			} else if responseStatus == byte(PASS_AUTH) {
 				p.state = p.authentication
 			} else {
+				p.setCloseReason("no acceptable authentication method")
 				return
 			}
 		case *passwordAuthentication:
@@ -84,54 +172,628 @@ func (p *proxy) Run() {
 			if responseStatus != SUCCESS {
 				return
 			}
+		case *socks4Request:
+			if responseStatus != SOCKS4_GRANTED {
+				return
+			}
 		}
 
 		_, err = p.input.Write(resp)
 		if err != nil {
+			p.setCloseReason(fmt.Sprintf("write error: %v", err))
 			p.log.Error(err.Error())
+			p.closeOutbound()
+			return
+		}
+
+		if p.udp != nil || p.bind != nil || p.output != nil {
+			// handshake is finished
+			p.input.SetDeadline(time.Time{})
+		}
+
+		if p.udp != nil {
+			p.log.Info(fmt.Sprintf("Start UDP relay %s <-> %s", p.input.RemoteAddr().String(), p.udp.LocalAddr().String()))
+			if timer := p.limitLifetime(); timer != nil {
+				defer timer.Stop()
+			}
+			if err := p.udp.Run(p.reader); err != nil {
+				p.setCloseReason(err.Error())
+			}
+			p.setCloseReason("closed by client")
+			p.log.Info(fmt.Sprintf("UDP association closed %s%s", p.input.RemoteAddr().String(), p.reasonSuffix()))
 			return
 		}
 
-		if p.output != nil{
-			defer p.output.Close()
+		if p.bind != nil {
+			p.log.Info(fmt.Sprintf("Waiting BIND connection for %s on %s", p.input.RemoteAddr().String(), p.bind.Addr().String()))
+			if !p.setAccepting(p.bind) {
+				p.bind.Close()
+				p.log.Info(fmt.Sprintf("Session %v closed: %s", p.input.RemoteAddr().String(), p.reason()))
+				return
+			}
+			resp, err = p.request.ReceiveBind()
+			p.setAccepting(nil)
+			p.metrics.reply(CMD_BIND, resp[1])
+			p.setReply(resp[1])
+			if _, ok := p.state.(*socks4Request); ok {
+				resp = p.socks4.reply(resp)
+			}
+			if err != nil {
+				p.protocolError(resp, err)
+				return
+			}
+
+			_, err = p.input.Write(resp)
+			if err != nil {
+				p.setCloseReason(fmt.Sprintf("write error: %v", err))
+				p.closeOutput()
+				p.log.Error(err.Error())
+				return
+			}
+		}
+
+		if p.output != nil {
+			defer p.closeOutput()
 			break
 		}
 	}
 
+	// Client may send application data right after the request,
+	// it's already buffered and has to be delivered first.
+	if n := p.reader.Buffered(); n > 0 {
+		early, _ := p.reader.Peek(n)
+		_, err := p.output.Write(early)
+		if err != nil {
+			p.setCloseReason(fmt.Sprintf("write error: %v", err))
+			p.log.Error(fmt.Sprintf("Write error %s <-> %s. Connection will be closed. Error: %s", p.input.RemoteAddr().String(), p.output.RemoteAddr().String(), err.Error()))
+			return
+		}
+		p.reader.Discard(n)
+		p.count(DIRECTION_UPLOAD, int64(n))
+	}
+
 	p.log.Info(fmt.Sprintf("Start proxing %s <-> %s",p.input.RemoteAddr().String(), p.output.RemoteAddr().String()) )
-	var wg sync.WaitGroup
-	wg.Add(2)
+	if timer := p.limitLifetime(); timer != nil {
+		defer timer.Stop()
+	}
+	p.relay()
+	p.log.Info(fmt.Sprintf("Session closed %s <-> %s: %s", p.input.RemoteAddr().String(), p.output.RemoteAddr().String(), p.reason()))
+}
 
-	go p.pipe(p.input, p.output)
-	go p.pipe(p.output, p.input)
+// relay copies data in both directions. EOF is propagated with a half-close,
+// so the session ends when both directions are finished, or when one of
+// them fails, in that case both connections are closed.
+func (p *proxy) relay() {
+	p.touch()
 
-	wg.Wait()
+	upload := newThrottle(p.cfg.Bandwidth, p.buckets, DIRECTION_UPLOAD, p.authentication.username, p.input.RemoteAddr())
+	defer upload.release()
+	download := newThrottle(p.cfg.Bandwidth, p.buckets, DIRECTION_DOWNLOAD, p.authentication.username, p.input.RemoteAddr())
+	defer download.release()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- p.pipe(p.input, p.output, upload, DIRECTION_UPLOAD)
+	}()
+	go func() {
+		errs <- p.pipe(p.output, p.input, download, DIRECTION_DOWNLOAD)
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			p.setCloseReason(err.Error())
+			p.closeInput()
+			p.closeOutput()
+		}
+	}
+	p.setCloseReason("closed by peers")
 }
 
-func (p *proxy) pipe(src net.Conn, dst net.Conn) {
-	buf := make([]byte, p.cfg.MTU)
+// pipe copies src to dst until EOF, then closes dst for writing.
+// It returns nil if EOF is reached. Throttled copy goes through a buffer,
+// nil throttle is unlimited.
+func (p *proxy) pipe(src net.Conn, dst net.Conn, limits *throttle, direction string) error {
+	count := func(n int64) {
+		p.count(direction, n)
+	}
+	if limits != nil {
+		p.log.Debug(fmt.Sprintf("Relay %s is throttled by %v limits", direction, limits.scopes))
+		count = func(n int64) {
+			p.count(direction, n)
+			p.throttle(limits, n)
+		}
+	}
+
+	var err error
+	if limits != nil {
+		_, err = p.copyIdle(dst, src, count)
+	} else {
+		_, err = p.copyConn(dst, src, count)
+	}
+
+	if err != nil {
+		if isTimeout(err) {
+			return fmt.Errorf("idle timeout (%s)", direction)
+		}
+		return fmt.Errorf("relay error (%s): %v", direction, err)
+	}
+
+	p.log.Debug(fmt.Sprintf("Connection half-closed %s: %s", direction, src.RemoteAddr().String()))
+	return p.closeWrite(dst)
+}
+
+const (
+	RELAY_BUFFER_SIZE = 32 * 1024
+	// RELAY_SPLICE_CHUNK limits a single splice, so relayed bytes
+	// are counted during long transfers
+	RELAY_SPLICE_CHUNK = 1024 * 1024
+)
+
+var relayBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, RELAY_BUFFER_SIZE)
+		return &buf
+	},
+}
+
+// copyConn copies src to dst until EOF. TCP to TCP copy goes through
+// ReadFrom, which uses splice on Linux, others use a pooled buffer.
+// count is called with every copied chunk. Each chunk is limited by
+// Config.IdleTimeout, if it's set, unless the other direction is active.
+func (p *proxy) copyConn(dst, src net.Conn, count func(int64)) (int64, error) {
+	var chunk func() (int64, error)
+	tcpSrc, srcOk := src.(*net.TCPConn)
+	tcpDst, dstOk := dst.(*net.TCPConn)
+	if srcOk && dstOk {
+		chunk = func() (int64, error) {
+			// ReadFrom splices *io.LimitedReader too
+			n, err := tcpDst.ReadFrom(&io.LimitedReader{R: tcpSrc, N: RELAY_SPLICE_CHUNK})
+			if n == 0 && err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+	} else {
+		bufp := relayBuffers.Get().(*[]byte)
+		defer relayBuffers.Put(bufp)
+		buf := *bufp
+		chunk = func() (int64, error) {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return 0, werr
+				}
+			}
+			return int64(n), err
+		}
+	}
+
+	var written int64
 	for {
+		if p.cfg.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(p.cfg.IdleTimeout))
+		}
+		n, err := chunk()
+		if n > 0 {
+			p.touch()
+			written += n
+			count(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil && isTimeout(err) && (n > 0 || p.idle() < p.cfg.IdleTimeout) {
+			// the chunk was being copied or the other direction is active
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// copyIdle copies src to dst until EOF through a pooled buffer for
+// throttled relays, each read is limited by Config.IdleTimeout, if it's set, unless
+// the other direction is active. Reads are not larger than Config.MTU.
+func (p *proxy) copyIdle(dst, src net.Conn, count func(int64)) (int64, error) {
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+	buf := *bufp
+	if p.cfg.MTU > 0 && p.cfg.MTU < len(buf) {
+		buf = buf[:p.cfg.MTU]
+	}
+
+	var written int64
+	for {
+		if p.cfg.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(p.cfg.IdleTimeout))
+		}
 		n, err := src.Read(buf)
-		if err != nil{
-			if err == io.EOF{
-				p.log.Info(fmt.Sprintf("Connection closed %s <-> %s",src.RemoteAddr().String(), dst.RemoteAddr().String()) )
-			}else{
-				p.log.Error(err.Error())
+		if n > 0 {
+			p.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return written, werr
 			}
-			return
+			written += int64(n)
+			count(int64(n))
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil && isTimeout(err) && p.idle() < p.cfg.IdleTimeout {
+			// the other direction is active
+			continue
 		}
-
-		_, err = dst.Write(buf[:n])
 		if err != nil {
-			p.log.Error(fmt.Sprintf("Write error %s <-> %s. Connection will be closed. Error: %s",src.RemoteAddr().String(), dst.RemoteAddr().String(), err.Error()) )
-			return
+			return written, err
+		}
+	}
+}
+
+// count adds relayed bytes of the direction.
+func (p *proxy) count(direction string, n int64) {
+	if direction == DIRECTION_UPLOAD {
+		atomic.AddInt64(&p.uploaded, n)
+	} else {
+		atomic.AddInt64(&p.downloaded, n)
+	}
+	p.metrics.relayed(direction, p.authentication.username, n)
+	if p.cfg.Quotas.add(p.authentication.username, n) {
+		p.Close("quota exceeded")
+	}
+}
+
+// throttle waits until bandwidth limits allow n relayed bytes,
+// waiting is interrupted when the session is closed.
+func (p *proxy) throttle(limits *throttle, n int64) {
+	delay, scope := limits.reserve(n)
+	if delay <= 0 {
+		return
+	}
+
+	p.metrics.throttleStarted(limits.direction, scope, delay)
+	defer p.metrics.throttleFinished(limits.direction)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.done:
+	}
+}
+
+// stage returns the handshake stage name of the current state.
+func (p *proxy) stage() string {
+	switch p.state.(type) {
+	case *negotiation:
+		return STAGE_NEGOTIATION
+	case *passwordAuthentication:
+		return STAGE_AUTHENTICATION
+	}
+	return STAGE_CONNECT
+}
+
+// handshakeResult tells whether the reply of the state accepts the client.
+func handshakeResult(s state, resp []byte, err error) string {
+	if err != nil || len(resp) < 2 {
+		return RESULT_FAILURE
+	}
+	switch s.(type) {
+	case *negotiation:
+		if resp[1] == byte(NOT_ACCEPTED) {
+			return RESULT_FAILURE
+		}
+	case *passwordAuthentication:
+		if resp[1] != PASS_AUTH_SUCCESS {
+			return RESULT_FAILURE
+		}
+	case *connect:
+		if resp[1] != SUCCESS {
+			return RESULT_FAILURE
+		}
+	case *socks4Request:
+		if resp[1] != SOCKS4_GRANTED {
+			return RESULT_FAILURE
+		}
+	}
+	return RESULT_SUCCESS
+}
+
+// Close closes the session from another goroutine, reason is logged
+// when the session ends.
+func (p *proxy) Close(reason string) {
+	p.setCloseReason(reason)
+
+	p.mu.Lock()
+	p.closed = true
+	accepting := p.accepting
+	p.mu.Unlock()
+
+	p.closeInput()
+	if accepting != nil {
+		accepting.Close()
+	}
+}
+
+// setAccepting registers the BIND listener, so Close interrupts waiting
+// for the inbound connection. It reports false if the session is closed.
+func (p *proxy) setAccepting(b *bind) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.accepting = b
+	return true
+}
+
+// closeWrite shuts down writing side of the connection, connection
+// without half-close support is closed completely.
+func (p *proxy) closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	if conn == p.input {
+		p.closeInput()
+	} else {
+		p.closeOutput()
+	}
+	return nil
+}
+
+// closeInput and closeOutput close the connections exactly once.
+func (p *proxy) closeInput() {
+	p.inputOnce.Do(func() {
+		p.input.Close()
+		close(p.done)
+	})
+}
+
+func (p *proxy) closeOutput() {
+	p.outputOnce.Do(func() {
+		if p.output != nil {
+			p.output.Close()
 		}
+	})
+}
+
+// limitLifetime closes the session when Config.MaxSessionLifetime
+// is exceeded, it returns nil if lifetime is unlimited.
+func (p *proxy) limitLifetime() *time.Timer {
+	if p.cfg.MaxSessionLifetime <= 0 {
+		return nil
+	}
+
+	return time.AfterFunc(p.cfg.MaxSessionLifetime-time.Since(p.started), func() {
+		p.setCloseReason("max session lifetime exceeded")
+		p.closeInput()
+		p.closeOutput()
+	})
+}
+
+func (p *proxy) touch() {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+}
+
+// idle returns time since the last relayed read in any direction.
+func (p *proxy) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+}
+
+// setCloseReason keeps the first reason the session is closed for.
+func (p *proxy) setCloseReason(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closeReason == "" {
+		p.closeReason = reason
+	}
+}
+
+func (p *proxy) reason() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeReason
+}
+
+func (p *proxy) reasonSuffix() string {
+	if reason := p.reason(); reason != "" {
+		return ": " + reason
+	}
+	return ""
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// readBytes reads exactly n bytes from r and appends them to input.
+func readBytes(r io.Reader, input []byte, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return append(input, buf...), nil
+}
+
+// closeOutbound releases sockets opened for the request
+// if the session ends before relaying.
+func (p *proxy) closeOutbound() {
+	p.closeOutput()
+	if p.udp != nil {
+		p.udp.Close()
+	}
+	if p.bind != nil {
+		p.bind.Close()
 	}
 }
 
 func (p *proxy) protocolError(resp []byte, err error) {
+	p.setCloseReason(err.Error())
 	if resp != nil {
 		p.input.Write(resp)
 	}
 	p.log.Error(err.Error())
 }
+
+// setRequest keeps the client request for the access log.
+func (p *proxy) setRequest(req *Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.req = req
+}
+
+// setReply keeps the last reply to the request.
+func (p *proxy) setReply(rep byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reply = rep
+	p.replied = true
+}
+
+// admitUser counts the session of the authenticated user for
+// Config.Limits.MaxSessionsPerUser, it reports false if the user
+// has too many sessions.
+func (p *proxy) admitUser() bool {
+	user := p.authentication.username
+	if user == "" || p.cfg.Limits.MaxSessionsPerUser <= 0 {
+		return true
+	}
+	if !p.counts.admitUser(user, p.cfg.Limits.MaxSessionsPerUser) {
+		p.metrics.connectionRejected(REJECT_USER_LIMIT)
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.countedUser = user
+	return true
+}
+
+func (p *proxy) releaseUser() {
+	p.mu.Lock()
+	user := p.countedUser
+	p.mu.Unlock()
+	if user != "" {
+		p.counts.releaseUser(user)
+	}
+}
+
+// trustedClient reports whether the client is exempt from AuthProtection.
+func (p *proxy) trustedClient() bool {
+	addr, ok := p.input.RemoteAddr().(*net.TCPAddr)
+	return p.guard == nil || ok && containsIP(p.cfg.AuthProtection.Trusted, addr.IP)
+}
+
+func (p *proxy) authLocked(user string) bool {
+	if p.trustedClient() || !p.guard.locked(clientIP(p.input.RemoteAddr()), user, time.Now()) {
+		return false
+	}
+	p.log.Info(fmt.Sprintf("Rejected authentication of %s from %v: locked out", user, p.input.RemoteAddr()))
+	return true
+}
+
+// authFailed counts the failure and delays the reply,
+// the delay is interrupted when the session is closed.
+func (p *proxy) authFailed(user string) {
+	if p.trustedClient() {
+		return
+	}
+
+	cfg := p.cfg.AuthProtection
+	client := clientIP(p.input.RemoteAddr())
+	delay, lockouts := p.guard.failed(client, user, cfg, time.Now())
+	for _, scope := range lockouts {
+		p.metrics.lockout(scope)
+		locked := client
+		if scope == LOCKOUT_USER {
+			locked = user
+		}
+		p.log.Warn(fmt.Sprintf("Authentication of %s %s is locked out for %v after %d failures", scope, locked, cfg.Lockout, cfg.MaxFailures))
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.done:
+		}
+	}
+}
+
+func (p *proxy) authSucceeded(user string) {
+	if !p.trustedClient() {
+		p.guard.succeeded(clientIP(p.input.RemoteAddr()), user)
+	}
+}
+
+// snapshot describes the session for Server.Sessions.
+func (p *proxy) snapshot() Session {
+	p.mu.Lock()
+	req := p.req
+	p.mu.Unlock()
+
+	session := Session{
+		ID:       p.id,
+		Client:   p.input.RemoteAddr(),
+		Request:  req,
+		Started:  p.started,
+		BytesIn:  atomic.LoadInt64(&p.uploaded),
+		BytesOut: atomic.LoadInt64(&p.downloaded),
+	}
+	if req != nil {
+		session.User = req.User
+	}
+	return session
+}
+
+// logAccess writes one access log record of the finished session.
+// bytes_in are received from the client, bytes_out are sent to it.
+func (p *proxy) logAccess() {
+	if p.accessLog == nil {
+		return
+	}
+
+	p.mu.Lock()
+	req, reply, replied, reason := p.req, p.reply, p.replied, p.closeReason
+	p.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.String("session", p.id),
+		zap.String("client", p.input.RemoteAddr().String()),
+		zap.String("user", p.authentication.username),
+	}
+	if req != nil {
+		ip := ""
+		if req.IP != nil {
+			ip = req.IP.String()
+		}
+		fields = append(fields,
+			zap.String("command", commandName(req.Command)),
+			zap.String("domain", req.Domain),
+			zap.String("ip", ip),
+			zap.Int("port", req.Port),
+		)
+	}
+	if replied {
+		fields = append(fields, zap.String("reply", replyName(reply)), zap.Int("reply_code", int(reply)))
+	}
+	fields = append(fields,
+		zap.Int64("bytes_in", atomic.LoadInt64(&p.uploaded)),
+		zap.Int64("bytes_out", atomic.LoadInt64(&p.downloaded)),
+		zap.Duration("duration", time.Since(p.started)),
+		zap.String("reason", reason),
+	)
+	p.accessLog.Info("session", fields...)
+}
+
+// newSessionID returns a random 16 hex digits identifier.
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,472 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_proxy_pipelinedHandshake(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	cfg := Config{Auth: NO_AUTH, MTU: 1400}
+	go newProxy(server, cfg, zap.NewNop()).Run()
+
+	addr := echo.Addr().(*net.TCPAddr)
+	payload := []byte("early data")
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+	message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+	message = append(message, addr.IP.To4()...)
+	message = append(message, intToByte(addr.Port)...)
+	message = append(message, payload...)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go client.Write(message)
+
+	negotiation := make([]byte, 2)
+	if _, err := io.ReadFull(client, negotiation); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(negotiation, []byte{PROTOCOL_VERSION, byte(NO_AUTH)}) {
+		t.Fatalf("negotiation reply got = %v", negotiation)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != SUCCESS {
+		t.Fatalf("connect reply got = %v", reply)
+	}
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("echo got = %q, want %q", got, payload)
+	}
+}
+
+// connectThroughProxy runs the proxy on a pipe and establishes
+// NO_AUTH CONNECT to the echo server.
+func connectThroughProxy(t *testing.T, cfg Config, echo net.Listener) net.Conn {
+	client, server := net.Pipe()
+	go newProxy(server, cfg, zap.NewNop()).Run()
+
+	addr := echo.Addr().(*net.TCPAddr)
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+	message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+	message = append(message, addr.IP.To4()...)
+	message = append(message, intToByte(addr.Port)...)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go client.Write(message)
+	if _, err := io.ReadFull(client, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// handshake dials the server at addr, authenticates as user and
+// establishes CONNECT to dst, nil dst stops after authentication. It
+// returns the status of the authentication reply and the CONNECT reply,
+// which is nil if the server closed the connection before it. A connection
+// closed before the authentication reply is reported as PASS_AUTH_FAIL.
+func handshake(t *testing.T, addr string, user, pass string, dst *net.TCPAddr) (net.Conn, byte, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(PASS_AUTH)}
+	message = append(message, PASS_AUTH_VERSION, byte(len(user)))
+	message = append(message, user...)
+	message = append(message, byte(len(pass)))
+	message = append(message, pass...)
+	conn.Write(message)
+	auth := make([]byte, 2+2)
+	if _, err := io.ReadFull(conn, auth); err != nil {
+		return conn, PASS_AUTH_FAIL, nil
+	}
+	if dst == nil || auth[3] != PASS_AUTH_SUCCESS {
+		return conn, auth[3], nil
+	}
+
+	message = []byte{PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4}
+	message = append(message, dst.IP.To4()...)
+	message = append(message, intToByte(dst.Port)...)
+	conn.Write(message)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return conn, auth[3], nil
+	}
+	return conn, auth[3], reply
+}
+
+func Test_proxy_timeouts(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	t.Run("handshake timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			newProxy(server, Config{MTU: 1400, HandshakeTimeout: 50 * time.Millisecond}, zap.NewNop()).Run()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session not closed by handshake timeout")
+		}
+	})
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"idle timeout", Config{MTU: 1400, IdleTimeout: 50 * time.Millisecond}},
+		{"max session lifetime", Config{MTU: 1400, MaxSessionLifetime: 100 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := connectThroughProxy(t, tt.cfg, echo)
+			defer client.Close()
+
+			client.SetDeadline(time.Now().Add(2 * time.Second))
+			_, err := client.Read(make([]byte, 1))
+			if err != io.EOF {
+				t.Errorf("Read() error = %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func Test_proxy_spliceIdleTimeout(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400, IdleTimeout: 100 * time.Millisecond}, nil)
+	defer server.Close()
+	listener := listenServer(t, server)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	addr := echo.Addr().(*net.TCPAddr)
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+	message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+	message = append(message, addr.IP.To4()...)
+	message = append(message, intToByte(addr.Port)...)
+	client.Write(message)
+	if _, err := io.ReadFull(client, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+
+	// data keeps the session open longer than the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte("ping"))
+		if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+			t.Fatalf("echo error = %v", err)
+		}
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_proxy_udpIdleTimeout(t *testing.T) {
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400, IdleTimeout: 100 * time.Millisecond}, nil)
+	defer server.Close()
+	listener := listenServer(t, server)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+	message = append(message, PROTOCOL_VERSION, CMD_UDP, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0)
+	client.Write(message)
+	if _, err := io.ReadFull(client, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_proxy_halfClose(t *testing.T) {
+	// target reads the request until EOF and only then answers
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := ioutil.ReadAll(conn)
+		conn.Write(bytes.ToUpper(request))
+	}()
+
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400}, nil)
+	listener := listenServer(t, server)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	addr := target.Addr().(*net.TCPAddr)
+	message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+	message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+	message = append(message, addr.IP.To4()...)
+	message = append(message, intToByte(addr.Port)...)
+	message = append(message, "request"...)
+	if _, err := client.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(client, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "REQUEST" {
+		t.Errorf("response got = %q, want %q", response, "REQUEST")
+	}
+
+	// session is finished, so nothing to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func Test_proxy_accessLog(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+
+	tests := []struct {
+		name       string
+		addr       *net.TCPAddr
+		payload    string
+		wantReply  string
+		wantBytes  int64
+		wantReason string
+	}{
+		{"relayed", echo.Addr().(*net.TCPAddr), "ping", "succeeded", 4, "closed by peers"},
+		{"refused", refused.Addr().(*net.TCPAddr), "", "connection refused", 0, "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			server := NewServer(Config{Auth: NO_AUTH, MTU: 1400}, nil)
+			server.AccessLog = zap.New(core)
+			listener := listenServer(t, server)
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SetDeadline(time.Now().Add(2 * time.Second))
+			message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+			message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+			message = append(message, tt.addr.IP.To4()...)
+			message = append(message, intToByte(tt.addr.Port)...)
+			message = append(message, tt.payload...)
+			client.Write(message)
+			io.ReadFull(client, make([]byte, 12+len(tt.payload)))
+			client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := logs.All()
+			if len(entries) != 1 {
+				t.Fatalf("access log records got = %v, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			want := map[string]interface{}{
+				"command":   "connect",
+				"ip":        "127.0.0.1",
+				"port":      int64(tt.addr.Port),
+				"reply":     tt.wantReply,
+				"bytes_in":  tt.wantBytes,
+				"bytes_out": tt.wantBytes,
+			}
+			for key, value := range want {
+				if fields[key] != value {
+					t.Errorf("%s got = %v, want %v", key, fields[key], value)
+				}
+			}
+			if reason, _ := fields["reason"].(string); !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("reason got = %v, want %v", reason, tt.wantReason)
+			}
+			if id, _ := fields["session"].(string); len(id) != 16 {
+				t.Errorf("session got = %v", fields["session"])
+			}
+		})
+	}
+}
+
+func listenServer(t *testing.T, server *Server) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return listener
+}
+
+// legacyPipe is the relay loop before copyConn: a fresh buffer
+// per direction and a Read/Write loop in user space.
+func legacyPipe(src net.Conn, dst net.Conn, mtu int) {
+	buf := make([]byte, mtu)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(b *testing.B, listener net.Listener) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client, server
+}
+
+func benchmarkRelay(b *testing.B, relay func(src, dst net.Conn)) {
+	const size = 4 << 20
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	payload := make([]byte, 64*1024)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		writer, src := tcpPair(b, listener)
+		dst, reader := tcpPair(b, listener)
+		b.StartTimer()
+
+		go func() {
+			for written := 0; written < size; written += len(payload) {
+				writer.Write(payload)
+			}
+			writer.Close()
+		}()
+		go func() {
+			relay(src, dst)
+			dst.Close()
+		}()
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		src.Close()
+		reader.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) {
+		benchmarkRelay(b, func(src, dst net.Conn) {
+			legacyPipe(src, dst, 1400)
+		})
+	})
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkRelay(b, func(src, dst net.Conn) {
+			// wrapped connections are not spliced
+			(&proxy{}).copyConn(struct{ net.Conn }{dst}, struct{ net.Conn }{src}, func(int64) {})
+		})
+	})
+	b.Run("splice", func(b *testing.B) {
+		benchmarkRelay(b, func(src, dst net.Conn) {
+			(&proxy{}).copyConn(dst, src, func(int64) {})
+		})
+	})
+	// idle timeout of the shipped config
+	idle := &proxy{cfg: Config{MTU: 1400, IdleTimeout: 5 * time.Minute}}
+	b.Run("splice idle timeout", func(b *testing.B) {
+		benchmarkRelay(b, func(src, dst net.Conn) {
+			idle.copyConn(dst, src, func(int64) {})
+		})
+	})
+	b.Run("copyIdle", func(b *testing.B) {
+		benchmarkRelay(b, func(src, dst net.Conn) {
+			idle.copyIdle(dst, src, func(int64) {})
+		})
+	})
+}
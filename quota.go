@@ -0,0 +1,187 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Quota limits bytes relayed by a user in both directions within
+// a calendar day and month of the server time zone. Zero is unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaLimits are quotas of authenticated users.
+type QuotaLimits struct {
+	// Default applies to users without their own quota
+	Default Quota
+	Users   map[string]Quota
+	// EnforceInSession closes sessions when the quota is exhausted,
+	// otherwise only new requests are rejected
+	EnforceInSession bool
+}
+
+func (l QuotaLimits) quota(user string) Quota {
+	if quota, ok := l.Users[user]; ok {
+		return quota
+	}
+	return l.Default
+}
+
+// QuotaUsage is bytes relayed by a user in the current day and month.
+type QuotaUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+const (
+	quotaDayLayout   = "2006-01-02"
+	quotaMonthLayout = "2006-01"
+)
+
+// Quotas accounts relayed bytes of authenticated users and keeps
+// the usage in a file, so it survives restarts. Nil Quotas limits nothing.
+type Quotas struct {
+	filename string
+	// now is time.Now, replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	limits QuotaLimits
+	usage  map[string]*QuotaUsage
+	dirty  bool
+}
+
+// LoadQuotas reads usage from the file, missing file is created on Save.
+func LoadQuotas(filename string) (*Quotas, error) {
+	q := &Quotas{filename: filename, now: time.Now, usage: map[string]*QuotaUsage{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetLimits replaces limits, usage is kept.
+func (q *Quotas) SetLimits(limits QuotaLimits) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits = limits
+}
+
+// Usage returns the usage of the user in the current windows.
+func (q *Quotas) Usage(user string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.current(user)
+}
+
+// Save writes the usage to the file if it's changed since the last Save.
+func (q *Quotas) Save() error {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// rename is atomic, the file is never left half written
+	tmp, err := ioutil.TempFile(filepath.Dir(q.filename), filepath.Base(q.filename)+".tmp")
+	if err != nil {
+		return q.failedSave(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return q.failedSave(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return q.failedSave(err)
+	}
+	if err := os.Rename(tmp.Name(), q.filename); err != nil {
+		return q.failedSave(err)
+	}
+	return nil
+}
+
+// failedSave keeps the usage dirty, so the next Save retries.
+func (q *Quotas) failedSave(err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dirty = true
+	return err
+}
+
+// exhausted reports whether the user has no quota left.
+func (q *Quotas) exhausted(user string) bool {
+	if q == nil || user == "" {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.isExhausted(user)
+}
+
+// add accounts n relayed bytes of the user. It reports true if the quota
+// is exhausted and it's enforced in sessions.
+func (q *Quotas) add(user string, n int64) bool {
+	if q == nil || user == "" || n <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.current(user)
+	usage.DayBytes += n
+	usage.MonthBytes += n
+	q.dirty = true
+	return q.limits.EnforceInSession && q.isExhausted(user)
+}
+
+func (q *Quotas) isExhausted(user string) bool {
+	quota := q.limits.quota(user)
+	usage := q.current(user)
+	return quota.Daily > 0 && usage.DayBytes >= quota.Daily ||
+		quota.Monthly > 0 && usage.MonthBytes >= quota.Monthly
+}
+
+// current returns the usage of the user, windows which are over
+// are started again.
+func (q *Quotas) current(user string) *QuotaUsage {
+	now := q.now()
+	day, month := now.Format(quotaDayLayout), now.Format(quotaMonthLayout)
+
+	usage, ok := q.usage[user]
+	if !ok {
+		usage = &QuotaUsage{Day: day, Month: month}
+		q.usage[user] = usage
+	}
+	if usage.Day != day {
+		usage.Day, usage.DayBytes = day, 0
+	}
+	if usage.Month != month {
+		usage.Month, usage.MonthBytes = month, 0
+	}
+	return usage
+}
@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "quotas.json")
+
+	quotas, err := LoadQuotas(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 3, 30, 23, 0, 0, 0, time.UTC)
+	quotas.now = func() time.Time { return now }
+	quotas.SetLimits(QuotaLimits{
+		Default:          Quota{Daily: 100},
+		Users:            map[string]Quota{"bob": {Monthly: 150}},
+		EnforceInSession: true,
+	})
+
+	if quotas.add("alice", 60) || quotas.exhausted("alice") {
+		t.Error("quota exhausted before the limit")
+	}
+	if !quotas.add("alice", 40) || !quotas.exhausted("alice") {
+		t.Error("daily quota is not exhausted")
+	}
+	quotas.add("bob", 120)
+	if quotas.exhausted("bob") || quotas.exhausted("") {
+		t.Error("user quota is not used")
+	}
+	if err := quotas.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// next day, the same month
+	now = now.Add(2 * time.Hour)
+	loaded, err := LoadQuotas(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.now = quotas.now
+	loaded.SetLimits(quotas.limits)
+	if loaded.exhausted("alice") {
+		t.Error("daily quota is not reset on the next day")
+	}
+	if got := loaded.Usage("bob"); got.MonthBytes != 120 || got.DayBytes != 0 || got.Month != "2020-03" {
+		t.Errorf("loaded usage got = %+v", got)
+	}
+}
+
+func TestQuotas_session(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	quotas := &Quotas{now: time.Now, usage: map[string]*QuotaUsage{}}
+	quotas.SetLimits(QuotaLimits{Users: map[string]Quota{"alice": {Daily: 4}}, EnforceInSession: true})
+	server := NewServer(Config{Auth: PASS_AUTH, Credentials: Credentials{"alice": "secret"}, MTU: 1400, Quotas: quotas}, nil)
+	listener := listenServer(t, server)
+	defer listener.Close()
+	defer server.Close()
+
+	connect := func() (net.Conn, byte) {
+		conn, _, reply := handshake(t, listener.Addr().String(), "alice", "secret", echo.Addr().(*net.TCPAddr))
+		if reply == nil {
+			t.Fatal("connection closed before the reply")
+		}
+		return conn, reply[1]
+	}
+
+	conn, reply := connect()
+	defer conn.Close()
+	if reply != SUCCESS {
+		t.Fatalf("reply got = %v, want %v", reply, SUCCESS)
+	}
+	// spliced relays are counted by RELAY_SPLICE_CHUNK
+	go conn.Write(make([]byte, RELAY_SPLICE_CHUNK))
+	// upload exhausts the quota, the session is closed
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("read after quota exceeded error = %v, want EOF", err)
+	}
+
+	rejected, reply := connect()
+	defer rejected.Close()
+	if reply != NOT_ALLOWED_BY_RULSET {
+		t.Errorf("reply of exhausted quota got = %v, want %v", reply, NOT_ALLOWED_BY_RULSET)
+	}
+}
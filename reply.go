@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// UpstreamError is returned when an upstream proxy refuses the request.
+type UpstreamError struct {
+	Upstream string
+	// Reply is REP code of SOCKS5 upstream or one mapped from HTTP status
+	Reply byte
+	Msg   string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s: %s", e.Upstream, e.Msg)
+}
+
+// replyCode classifies dial and resolve errors into REP codes.
+func replyCode(err error) byte {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.Reply
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return TTL_EXPIRED
+		}
+		return HOST_UNREACHABLE
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return HOST_UNREACHABLE
+	case errors.Is(err, syscall.ETIMEDOUT):
+		return TTL_EXPIRED
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TTL_EXPIRED
+	}
+	return GENERAL_ERROR
+}
+
+// httpReplyCode maps HTTP CONNECT response status into REP code.
+func httpReplyCode(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return NOT_ALLOWED_BY_RULSET
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return HOST_UNREACHABLE
+	case http.StatusGatewayTimeout:
+		return TTL_EXPIRED
+	}
+	return GENERAL_ERROR
+}
+
+func replyName(rep byte) string {
+	switch rep {
+	case SUCCESS:
+		return "succeeded"
+	case GENERAL_ERROR:
+		return "general failure"
+	case NOT_ALLOWED_BY_RULSET:
+		return "not allowed by ruleset"
+	case NETWORK_UNREACHABLE:
+		return "network unreachable"
+	case HOST_UNREACHABLE:
+		return "host unreachable"
+	case CONNECTION_REFUSED:
+		return "connection refused"
+	case TTL_EXPIRED:
+		return "TTL expired"
+	case COMMAND_NOT_SUPPORTED:
+		return "command not supported"
+	case ADDRESS_TYPE_NOT_SUPPORTED:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("reply 0x%02x", rep)
+}
+
+// replyError adds the reply classification to err.
+func replyError(rep byte, err error) error {
+	return fmt.Errorf("%s: %w", replyName(rep), err)
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func Test_replyCode(t *testing.T) {
+	opError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"refused", opError(syscall.ECONNREFUSED), CONNECTION_REFUSED},
+		{"network unreachable", opError(syscall.ENETUNREACH), NETWORK_UNREACHABLE},
+		{"host unreachable", opError(syscall.EHOSTUNREACH), HOST_UNREACHABLE},
+		{"timed out", opError(syscall.ETIMEDOUT), TTL_EXPIRED},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, TTL_EXPIRED},
+		{"nxdomain", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, HOST_UNREACHABLE},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}, TTL_EXPIRED},
+		{"upstream", &UpstreamError{Upstream: "proxy:1080", Reply: CONNECTION_REFUSED}, CONNECTION_REFUSED},
+		{"wrapped upstream", replyError(GENERAL_ERROR, &UpstreamError{Reply: NOT_ALLOWED_BY_RULSET}), NOT_ALLOWED_BY_RULSET},
+		{"unknown", errors.New("unknown"), GENERAL_ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCode(tt.err); got != tt.want {
+				t.Errorf("replyCode() = %v, want %v", replyName(got), replyName(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Request describes a client request evaluated by RuleSet.
+type Request struct {
+	Command byte
+	Source  net.IP
+	User    string
+	// Domain is empty if the client requested an IP address
+	Domain string
+	IP     net.IP
+	Port   int
+}
+
+type PortRange struct {
+	From int
+	To   int
+}
+
+// Rule matches a request when every non empty criterion matches it,
+// a criterion matches when any of its values matches.
+type Rule struct {
+	Name  string
+	Allow bool
+	// Destinations is matched against the requested or resolved IP
+	Destinations []*net.IPNet
+	// Domains are exact names or wildcards like *.example.com,
+	// which match subdomains only
+	Domains  []string
+	Ports    []PortRange
+	Commands []byte
+	Sources  []*net.IPNet
+	Users    []string
+}
+
+// RuleSet is an ordered list of rules, the first matched rule decides.
+type RuleSet struct {
+	Rules []Rule
+	// DefaultAllow is the decision when no rule matches
+	DefaultAllow bool
+	// ResolveUpstream resolves domains sent to upstreams locally, so
+	// Destinations apply to them, a domain which can't be resolved matches
+	// deny rules with Destinations and no allow ones. Otherwise such domains
+	// are resolved by the upstream only and Destinations don't match them.
+	ResolveUpstream bool
+}
+
+// Evaluate returns the decision and the name of the rule that made it.
+// Nil RuleSet allows everything.
+func (rs *RuleSet) Evaluate(req *Request) (bool, string) {
+	if rs == nil {
+		return true, "default"
+	}
+
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if rule.match(req, rs.ResolveUpstream) {
+			if rule.Name != "" {
+				return rule.Allow, rule.Name
+			}
+			return rule.Allow, fmt.Sprintf("#%d", i+1)
+		}
+	}
+	return rs.DefaultAllow, "default"
+}
+
+// resolvesUpstream reports whether domains sent to upstreams have to be
+// resolved locally for rules which match destination IPs.
+func (rs *RuleSet) resolvesUpstream() bool {
+	if rs == nil || !rs.ResolveUpstream {
+		return false
+	}
+	for i := range rs.Rules {
+		if len(rs.Rules[i].Destinations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) match(req *Request, resolveUpstream bool) bool {
+	return rule.matchDestination(req, resolveUpstream) &&
+		rule.matchDomain(req.Domain) &&
+		rule.matchPort(req.Port) &&
+		rule.matchCommand(req.Command) &&
+		rule.matchSource(req.Source) &&
+		rule.matchUser(req.User)
+}
+
+// matchDestination treats a domain which isn't resolved as any IP if
+// domains sent to upstreams are resolved: it matches deny rules and
+// doesn't match allow rules.
+func (rule *Rule) matchDestination(req *Request, resolveUpstream bool) bool {
+	if len(rule.Destinations) == 0 {
+		return true
+	}
+	if resolveUpstream && req.IP == nil && req.Domain != "" {
+		return !rule.Allow
+	}
+	return containsIP(rule.Destinations, req.IP)
+}
+
+func (rule *Rule) matchSource(ip net.IP) bool {
+	return len(rule.Sources) == 0 || containsIP(rule.Sources, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchDomain(domain string) bool {
+	return len(rule.Domains) == 0 || matchDomain(rule.Domains, domain)
+}
+
+// matchDomain reports whether domain equals any of patterns or is
+// a subdomain of a *.example.com wildcard.
+func matchDomain(patterns []string, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchPort(port int) bool {
+	if len(rule.Ports) == 0 {
+		return true
+	}
+	for _, r := range rule.Ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchCommand(cmd byte) bool {
+	if len(rule.Commands) == 0 {
+		return true
+	}
+	for _, c := range rule.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchUser(user string) bool {
+	if len(rule.Users) == 0 {
+		return true
+	}
+	for _, u := range rule.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case CMD_CONNECT:
+		return "connect"
+	case CMD_BIND:
+		return "bind"
+	case CMD_UDP:
+		return "udp"
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+// CommandName returns connect, bind or udp.
+func (req *Request) CommandName() string {
+	return commandName(req.Command)
+}
+
+func (req *Request) String() string {
+	dst := net.JoinHostPort(req.IP.String(), fmt.Sprint(req.Port))
+	if req.Domain != "" {
+		dst = net.JoinHostPort(req.Domain, fmt.Sprint(req.Port))
+		if req.IP != nil {
+			dst += fmt.Sprintf(" (%s)", req.IP)
+		}
+	}
+	s := fmt.Sprintf("%s %s from %s", commandName(req.Command), dst, req.Source)
+	if req.User != "" {
+		s += " user " + req.User
+	}
+	return s
+}
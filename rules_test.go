@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func TestRuleSet_Evaluate(t *testing.T) {
+	rules := &RuleSet{
+		Rules: []Rule{
+			{Name: "deny smtp", Allow: false, Ports: []PortRange{{25, 25}, {465, 465}, {587, 587}}},
+			{Name: "deny private", Allow: false, Destinations: []*net.IPNet{mustCIDR("10.0.0.0/8")}, Users: []string{"guest"}},
+			{Name: "example", Allow: true, Domains: []string{"example.com", "*.example.com"}, Commands: []byte{CMD_CONNECT}},
+			{Name: "local udp", Allow: true, Commands: []byte{CMD_UDP}, Sources: []*net.IPNet{mustCIDR("127.0.0.0/8")}},
+			{Allow: true, Ports: []PortRange{{8000, 9000}}},
+		},
+		DefaultAllow: false,
+	}
+
+	resolving := *rules
+	resolving.ResolveUpstream = true
+
+	local := net.IPv4(127, 0, 0, 1)
+	tests := []struct {
+		name     string
+		rules    *RuleSet
+		req      *Request
+		want     bool
+		wantRule string
+	}{
+		{"nil ruleset", nil, &Request{Command: CMD_CONNECT, IP: net.IPv4(1, 1, 1, 1), Port: 25}, true, "default"},
+		{"port", rules, &Request{Command: CMD_CONNECT, Domain: "example.com", IP: net.IPv4(1, 1, 1, 1), Port: 587}, false, "deny smtp"},
+		{"cidr and user", rules, &Request{Command: CMD_CONNECT, IP: net.IPv4(10, 1, 2, 3), Port: 8080, User: "guest"}, false, "deny private"},
+		{"unresolved domain", rules, &Request{Command: CMD_CONNECT, Domain: "intranet.corp", Port: 8080, User: "guest"}, true, "#5"},
+		{"unresolved domain resolving upstream", &resolving, &Request{Command: CMD_CONNECT, Domain: "intranet.corp", Port: 8080, User: "guest"}, false, "deny private"},
+		{"cidr other user", rules, &Request{Command: CMD_CONNECT, IP: net.IPv4(10, 1, 2, 3), Port: 8080, User: "admin"}, true, "#5"},
+		{"exact domain", rules, &Request{Command: CMD_CONNECT, Domain: "Example.COM.", IP: net.IPv4(1, 1, 1, 1), Port: 443}, true, "example"},
+		{"wildcard domain", rules, &Request{Command: CMD_CONNECT, Domain: "a.b.example.com", IP: net.IPv4(1, 1, 1, 1), Port: 443}, true, "example"},
+		{"wildcard suffix only", rules, &Request{Command: CMD_CONNECT, Domain: "badexample.com", IP: net.IPv4(1, 1, 1, 1), Port: 443}, false, "default"},
+		{"domain rule with ip", rules, &Request{Command: CMD_CONNECT, IP: net.IPv4(1, 1, 1, 1), Port: 443}, false, "default"},
+		{"domain wrong command", rules, &Request{Command: CMD_BIND, Domain: "example.com", IP: net.IPv4(1, 1, 1, 1), Port: 443}, false, "default"},
+		{"source", rules, &Request{Command: CMD_UDP, Source: local, IP: net.IPv4(8, 8, 8, 8), Port: 53}, true, "local udp"},
+		{"other source", rules, &Request{Command: CMD_UDP, Source: net.IPv4(192, 168, 0, 1), IP: net.IPv4(8, 8, 8, 8), Port: 53}, false, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rule := tt.rules.Evaluate(tt.req)
+			if got != tt.want || rule != tt.wantRule {
+				t.Errorf("Evaluate() = %v, %v, want %v, %v", got, rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	SOCKS4_VERSION = 0x04
+	// SOCKS4_REPLY_VERSION is VN of replies
+	SOCKS4_REPLY_VERSION = 0x00
+)
+
+// input positions
+const (
+	S4_ARG_VERSION = 0
+	S4_ARG_CMD     = 1
+	S4_ARG_PORT    = 2
+	S4_ARG_IP      = 4
+	S4_ARG_USERID  = 8
+)
+
+// response values
+const (
+	SOCKS4_GRANTED  = 0x5a
+	SOCKS4_REJECTED = 0x5b
+)
+
+// SOCKS4_MAX_FIELD limits USERID and the SOCKS4a hostname,
+// longer fields are not terminated and the request is rejected.
+const SOCKS4_MAX_FIELD = 255
+
+// socks4Request handles SOCKS4 and SOCKS4a CONNECT and BIND requests.
+// The request is translated to SOCKS5 and served by connect, so it goes
+// through the same ruleset, router, limits and logs.
+type socks4Request struct {
+	proxy *proxy
+	// rep is the SOCKS5 REP code of the reply for metrics and logs
+	rep byte
+}
+
+func newSocks4Request(proxy *proxy) *socks4Request {
+	return &socks4Request{proxy: proxy}
+}
+
+// Read reads VN, CD, DSTPORT, DSTIP, null terminated USERID and,
+// for SOCKS4a, null terminated hostname.
+func (state *socks4Request) Read(r io.Reader) ([]byte, error) {
+	input, err := readBytes(r, nil, S4_ARG_USERID)
+	if err != nil {
+		return nil, err
+	}
+	input, err = readField(r, input)
+	if err != nil {
+		return nil, err
+	}
+	if isSocks4a(input[S4_ARG_IP : S4_ARG_IP+net.IPv4len]) {
+		return readField(r, input)
+	}
+	return input, nil
+}
+
+// Receive returns the SOCKS4 reply, with an error if the request
+// is rejected.
+func (state *socks4Request) Receive(input []byte) ([]byte, error) {
+	if err := state.validate(input); err != nil {
+		state.rep = GENERAL_ERROR
+		return state.failure(), replyError(GENERAL_ERROR, err)
+	}
+
+	// USERID is logged only, SOCKS4 clients are not authenticated
+	userID, host := socks4Fields(input)
+	state.proxy.log.Info(fmt.Sprintf("SOCKS4 request from %v, user id %q", state.proxy.input.RemoteAddr(), userID))
+	if state.proxy.cfg.Auth != NO_AUTH {
+		// SOCKS4 has no authentication, the server would be open otherwise
+		state.rep = NOT_ALLOWED_BY_RULSET
+		return state.failure(), replyError(NOT_ALLOWED_BY_RULSET, errors.New("SOCKS4 requires authentication disabled"))
+	}
+
+	request := []byte{PROTOCOL_VERSION, input[S4_ARG_CMD], 0x00}
+	if host != "" {
+		request = append(request, ATYP_DOMAIN, byte(len(host)))
+		request = append(request, host...)
+	} else {
+		request = append(request, ATYP_IPV4)
+		request = append(request, input[S4_ARG_IP:S4_ARG_IP+net.IPv4len]...)
+	}
+	request = append(request, input[S4_ARG_PORT:S4_ARG_IP]...)
+
+	resp, err := state.proxy.request.Receive(request)
+	state.rep = resp[1]
+	return state.reply(resp), err
+}
+
+// reply translates the SOCKS5 reply of connect. The bound IPv6
+// address can't be sent, it's replied as 0.0.0.0.
+func (state *socks4Request) reply(resp []byte) []byte {
+	if resp[1] != SUCCESS {
+		return state.failure()
+	}
+
+	r := []byte{SOCKS4_REPLY_VERSION, SOCKS4_GRANTED}
+	if resp[CON_ARG_ATYP] == ATYP_IPV4 {
+		r = append(r, resp[8:10]...)
+		return append(r, resp[4:8]...)
+	}
+	r = append(r, resp[len(resp)-2:]...)
+	return append(r, net.IPv4zero.To4()...)
+}
+
+func (state *socks4Request) failure() []byte {
+	return []byte{SOCKS4_REPLY_VERSION, SOCKS4_REJECTED, 0, 0, 0, 0, 0, 0}
+}
+
+func (state *socks4Request) validate(input []byte) error {
+	if len(input) < S4_ARG_USERID+1 {
+		return errors.New("invalid message length")
+	}
+
+	if input[S4_ARG_VERSION] != SOCKS4_VERSION {
+		return errors.New("invalid protocol version")
+	}
+
+	if input[S4_ARG_CMD] != CMD_CONNECT && input[S4_ARG_CMD] != CMD_BIND {
+		return errors.New("invalid command")
+	}
+
+	if _, host := socks4Fields(input); isSocks4a(input[S4_ARG_IP:S4_ARG_IP+net.IPv4len]) && host == "" {
+		return errors.New("invalid domain")
+	}
+	return nil
+}
+
+// socks4Fields returns USERID and the SOCKS4a hostname of the request,
+// hostname is empty for SOCKS4.
+func socks4Fields(input []byte) (string, string) {
+	fields := bytes.Split(input[S4_ARG_USERID:], []byte{0})
+	userID := string(fields[0])
+	if len(fields) > 1 && isSocks4a(input[S4_ARG_IP:S4_ARG_IP+net.IPv4len]) {
+		return userID, string(fields[1])
+	}
+	return userID, ""
+}
+
+// isSocks4a reports whether DSTIP is 0.0.0.x with non zero x,
+// which means the hostname follows USERID.
+func isSocks4a(ip []byte) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+// readField reads a null terminated field and appends it
+// with the terminator to input.
+func readField(r io.Reader, input []byte) ([]byte, error) {
+	for i := 0; i <= SOCKS4_MAX_FIELD; i++ {
+		var err error
+		input, err = readBytes(r, input, 1)
+		if err != nil {
+			return nil, err
+		}
+		if input[len(input)-1] == 0 {
+			return input, nil
+		}
+	}
+	return nil, errors.New("field is too long")
+}
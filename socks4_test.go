@@ -0,0 +1,175 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_socks4Request_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"socks4", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0, 'x'},
+			[]byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b', 0}, false},
+		{"socks4a", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 0, 0, 0, 1, 0, 'a', '.', 'b', 0, 'x'},
+			[]byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 0, 0, 0, 1, 0, 'a', '.', 'b', 0}, false},
+		{"not terminated", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1, 'b', 'o', 'b'}, nil, true},
+		{"too long", append([]byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1}, strings.Repeat("u", SOCKS4_MAX_FIELD+1)+"\x00"...), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&socks4Request{}).Read(bytes.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_socks4Request_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+	}{
+		{"connect", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1, 0}, false},
+		{"bind", []byte{SOCKS4_VERSION, CMD_BIND, 0, 80, 10, 0, 0, 1, 0}, false},
+		{"socks4a", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 0, 0, 0, 1, 0, 'a', 0}, false},
+		{"udp", []byte{SOCKS4_VERSION, CMD_UDP, 0, 80, 10, 0, 0, 1, 0}, true},
+		{"version", []byte{PROTOCOL_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1, 0}, true},
+		{"empty hostname", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 0, 0, 0, 1, 0, 0}, true},
+		{"short", []byte{SOCKS4_VERSION, CMD_CONNECT, 0, 80, 10, 0, 0, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&socks4Request{}).validate(tt.input); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_socks4(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	addr := echo.Addr().(*net.TCPAddr)
+
+	// request sends the SOCKS4 request to a new server with cfg and
+	// returns the reply, nil if the connection is closed without reply.
+	// stop closes the server.
+	request := func(t *testing.T, cfg Config, message []byte) (conn net.Conn, reply []byte, stop func()) {
+		server := NewServer(cfg, nil)
+		listener := listenServer(t, server)
+		stop = func() {
+			listener.Close()
+			server.Close()
+		}
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			stop()
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(message)
+		reply = make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return conn, nil, stop
+		}
+		return conn, reply, stop
+	}
+	assertEcho := func(t *testing.T, conn net.Conn) {
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Errorf("echo got = %q, %v", got, err)
+		}
+	}
+	connect := append([]byte{SOCKS4_VERSION, CMD_CONNECT}, intToByte(addr.Port)...)
+	connect = append(connect, addr.IP.To4()...)
+	connect = append(connect, "bob\x00"...)
+	enabled := Config{Auth: NO_AUTH, MTU: 1400, SOCKS4: true}
+
+	t.Run("connect", func(t *testing.T) {
+		conn, reply, stop := request(t, enabled, connect)
+		defer stop()
+		if reply == nil || reply[0] != SOCKS4_REPLY_VERSION || reply[1] != SOCKS4_GRANTED {
+			t.Fatalf("reply got = %v", reply)
+		}
+		assertEcho(t, conn)
+	})
+
+	t.Run("socks4a", func(t *testing.T) {
+		message := append([]byte{SOCKS4_VERSION, CMD_CONNECT}, intToByte(addr.Port)...)
+		message = append(message, 0, 0, 0, 1)
+		message = append(message, "bob\x00127.0.0.1\x00"...)
+		conn, reply, stop := request(t, enabled, message)
+		defer stop()
+		if reply == nil || reply[1] != SOCKS4_GRANTED {
+			t.Fatalf("reply got = %v", reply)
+		}
+		assertEcho(t, conn)
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		message := append([]byte{SOCKS4_VERSION, CMD_BIND, 0, 0}, net.IPv4(127, 0, 0, 1).To4()...)
+		message = append(message, 0)
+		conn, reply, stop := request(t, enabled, message)
+		defer stop()
+		if reply == nil || reply[1] != SOCKS4_GRANTED {
+			t.Fatalf("reply got = %v", reply)
+		}
+		bound := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[2])<<8 | int(reply[3])}
+		peer, err := net.Dial("tcp", bound.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		second := make([]byte, 8)
+		if _, err := io.ReadFull(conn, second); err != nil || second[1] != SOCKS4_GRANTED {
+			t.Fatalf("second reply got = %v, %v", second, err)
+		}
+		peer.Write([]byte("pong"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "pong" {
+			t.Errorf("relayed got = %q, %v", got, err)
+		}
+	})
+
+	t.Run("denied by ruleset", func(t *testing.T) {
+		cfg := enabled
+		cfg.Rules = &RuleSet{}
+		_, reply, stop := request(t, cfg, connect)
+		defer stop()
+		if reply == nil || reply[1] != SOCKS4_REJECTED {
+			t.Errorf("reply got = %v, want rejected", reply)
+		}
+	})
+
+	t.Run("password auth", func(t *testing.T) {
+		cfg := Config{Auth: PASS_AUTH, Credentials: Credentials{"bob": "secret"}, MTU: 1400, SOCKS4: true}
+		_, reply, stop := request(t, cfg, connect)
+		defer stop()
+		if reply == nil || reply[1] != SOCKS4_REJECTED {
+			t.Errorf("reply got = %v, want rejected", reply)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, reply, stop := request(t, Config{Auth: NO_AUTH, MTU: 1400}, connect)
+		defer stop()
+		if reply != nil {
+			t.Errorf("reply got = %v, want closed connection", reply)
+		}
+	})
+}
@@ -1,88 +1,285 @@
-package main
+// Package socks5 implements a SOCKS5 proxy server (RFC 1928, RFC 1929).
+package socks5
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-	"gopkg.in/natefinch/lumberjack.v2"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
-const configFilename string = "socks5.yaml"
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+// or Close.
+var ErrServerClosed = errors.New("socks5: server closed")
 
-func main() {
+const shutdownPollInterval = 500 * time.Millisecond
 
-	var cfg config
-	var ok bool
-	if cfg, ok = tryParseConfig(); !ok {
-		return
-	}
+// Server accepts client connections and proxies them according to Config.
+type Server struct {
+	Config Config
+	Logger *zap.Logger
+	// Metrics is nil if metrics are not collected
+	Metrics *Metrics
+	// AccessLog receives one record per finished session, nil disables it
+	AccessLog *zap.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	sessions  map[*proxy]struct{}
+	closed    bool
+	// buckets are bandwidth limits shared by sessions
+	buckets buckets
+	counts  sessionCounts
+	guard   authGuard
+}
 
-	logger := newLogger("socks5")
-	defer logger.Sync()
+func NewServer(cfg Config, logger *zap.Logger) *Server {
+	return &Server{Config: cfg, Logger: logger}
+}
 
-	listener, err := Listen(cfg.Network, fmt.Sprintf("%s:%d",cfg.Address,cfg.Port))
+// ListenAndServe listens on Config.Network and Config.Address:Config.Port
+// and serves incoming connections.
+func (s *Server) ListenAndServe() error {
+	cfg := s.config()
+	if cfg.Address == "" {
+		return errors.New("Address is empty")
+	}
+
+	listener, err := net.Listen(cfg.Network, net.JoinHostPort(cfg.Address, strconv.Itoa(cfg.Port)))
 	if err != nil {
-		logger.Error(err.Error())
-		return
+		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener and serves each one in its own
+// goroutine. Serve always closes the listener and returns a non-nil error,
+// ErrServerClosed after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+	defer listener.Close()
 
 	for {
-		conn, err := NewConnection(listener)
+		conn, err := listener.Accept()
 		if err != nil {
-			logger.Error(err.Error())
-			break
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.Metrics.connectionAccepted()
+		cfg := s.config()
+		client := clientIP(conn.RemoteAddr())
+		if reason := s.counts.admit(client, cfg.Limits); reason != "" {
+			s.Metrics.connectionRejected(reason)
+			s.logger().Warn(fmt.Sprintf("Rejected connection from %v: %s limit exceeded", conn.RemoteAddr(), reason))
+			conn.Close()
+			continue
+		}
+
+		session := newProxy(conn, cfg, s.logger())
+		session.metrics = s.Metrics
+		session.accessLog = s.AccessLog
+		session.buckets = &s.buckets
+		session.counts = &s.counts
+		session.guard = &s.guard
+		if !s.trackSession(session, true) {
+			s.counts.release(client)
+			conn.Close()
+			return ErrServerClosed
 		}
-		logger.Info(fmt.Sprintf("Opened connection from: %v", conn.RemoteAddr()))
-		go Start(conn, cfg, logger)
+
+		s.logger().Info(fmt.Sprintf("Opened connection from: %v", conn.RemoteAddr()))
+		go func() {
+			defer s.trackSession(session, false)
+			defer s.counts.release(client)
+			session.Run()
+		}()
 	}
+}
 
+// Shutdown stops accepting new connections and waits until all active
+// sessions are finished or ctx is done, in that case ctx error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.ActiveSessions() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
-func NewConnection(listen net.Listener) (net.Conn, error) {
-	conn, err := listen.Accept()
-	if err != nil {
-		return nil, err
+// Reload replaces Config for new sessions, active sessions keep the config
+// they were started with. Network, Address and Port are not changed,
+// listeners have to be restarted for that.
+func (s *Server) Reload(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg.Network = s.Config.Network
+	cfg.Address = s.Config.Address
+	cfg.Port = s.Config.Port
+	s.Config = cfg
+}
+
+func (s *Server) config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Config
+}
+
+// Close stops accepting new connections and closes all active sessions
+// immediately. It returns the number of closed sessions.
+func (s *Server) Close() int {
+	s.closeListeners()
+
+	sessions := s.activeSessions()
+	for _, session := range sessions {
+		session.Close("server shutdown")
 	}
-	return conn, nil
+	return len(sessions)
 }
 
-func Listen(network string, addr string) (net.Listener, error) {
-	if addr == "" {
-		return nil, errors.New("Address is empty")
+// ActiveSessions returns the number of sessions being served.
+func (s *Server) ActiveSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Session is a snapshot of an active session.
+type Session struct {
+	ID     string
+	Client net.Addr
+	// User is empty without authentication and before the request
+	User string
+	// Request is nil before the request is received
+	Request *Request
+	Started time.Time
+	// BytesIn are received from the client, BytesOut are sent to it
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Sessions returns snapshots of active sessions, the oldest first.
+func (s *Server) Sessions() []Session {
+	sessions := s.activeSessions()
+	snapshots := make([]Session, len(sessions))
+	for i, session := range sessions {
+		snapshots[i] = session.snapshot()
 	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Started.Before(snapshots[j].Started)
+	})
+	return snapshots
+}
 
-	listener, err := net.Listen(network, addr)
-	if err != nil {
-		return nil, err
+// CloseSession closes the active session with the id,
+// it reports false if there is no such session.
+func (s *Server) CloseSession(id string) bool {
+	return s.CloseSessions(func(session Session) bool {
+		return session.ID == id
+	}) > 0
+}
+
+// CloseSessions closes active sessions matched by match and returns
+// the number of closed sessions.
+func (s *Server) CloseSessions(match func(Session) bool) int {
+	closed := 0
+	for _, session := range s.activeSessions() {
+		if match(session.snapshot()) {
+			session.Close("terminated")
+			closed++
+		}
 	}
-	return listener, nil
+	return closed
 }
 
-func newLogger(name string) *zap.Logger {
+func (s *Server) activeSessions() []*proxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*proxy, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
 
-	mainLogger := zapcore.AddSync(&lumberjack.Logger{
-		Filename:   fmt.Sprintf("%s/%s.log", "./", name),
-		MaxSize:    100, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28, // days
-	})
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+}
 
-	encoderConfig := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
-		MessageKey: "message",
+func (s *Server) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
 
-		LevelKey:    "level",
-		EncodeLevel: zapcore.CapitalLevelEncoder,
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
 
-		TimeKey:    "time",
-		EncodeTime: zapcore.ISO8601TimeEncoder,
+// trackListener adds or removes the listener, it reports false
+// if the server is already shut down.
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		CallerKey:    "caller",
-		EncodeCaller: zapcore.ShortCallerEncoder,
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(s.listeners, listener)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
 
-		EncodeDuration: zapcore.StringDurationEncoder,
-	})
+// trackSession adds or removes the session, it reports false
+// if the server is already shut down.
+func (s *Server) trackSession(session *proxy, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return zap.New(zapcore.NewCore(encoderConfig, mainLogger, zapcore.DebugLevel))
+	if s.sessions == nil {
+		s.sessions = make(map[*proxy]struct{})
+	}
+	if !add {
+		delete(s.sessions, session)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.sessions[session] = struct{}{}
+	return true
 }
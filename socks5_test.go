@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400}, nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the session to be accepted
+	conn.Write([]byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() with active session error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Serve() error = %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve() not returned after Shutdown()")
+	}
+
+	conn.Close()
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400}, nil)
+	go server.Serve(listener)
+
+	request := func(cmd byte, addr *net.TCPAddr) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+		message = append(message, PROTOCOL_VERSION, cmd, 0x00, ATYP_IPV4)
+		message = append(message, addr.IP.To4()...)
+		message = append(message, intToByte(addr.Port)...)
+		conn.Write(message)
+		if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	connect := request(CMD_CONNECT, echo.Addr().(*net.TCPAddr))
+	defer connect.Close()
+	bind := request(CMD_BIND, &net.TCPAddr{IP: net.IPv4zero})
+	defer bind.Close()
+
+	if got := server.Close(); got != 2 {
+		t.Errorf("Close() got = %v, want 2", got)
+	}
+
+	for _, conn := range []net.Conn{connect, bind} {
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after Close() error = %v, want %v", err, io.EOF)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() after Close() error = %v", err)
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(Config{Address: "127.0.0.1", Auth: NO_AUTH, MTU: 1400}, nil)
+	defer server.Close()
+	go server.Serve(listener)
+
+	negotiate := func() byte {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte{PROTOCOL_VERSION, 0x02, byte(NO_AUTH), byte(PASS_AUTH)})
+		resp := make([]byte, 2)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp[1]
+	}
+
+	if got := negotiate(); got != byte(NO_AUTH) {
+		t.Errorf("method before Reload() got = %v, want %v", got, NO_AUTH)
+	}
+
+	server.Reload(Config{Address: "0.0.0.0", Auth: PASS_AUTH, Credentials: Credentials{"user": "pass"}, MTU: 1400})
+	if got := negotiate(); got != byte(PASS_AUTH) {
+		t.Errorf("method after Reload() got = %v, want %v", got, PASS_AUTH)
+	}
+	if server.Config.Address != "127.0.0.1" {
+		t.Errorf("Reload() changed Address to %v", server.Config.Address)
+	}
+}
+
+func TestServer_Sessions(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	server := NewServer(Config{Auth: NO_AUTH, MTU: 1400}, nil)
+	listener := listenServer(t, server)
+	defer listener.Close()
+	defer server.Close()
+
+	addr := echo.Addr().(*net.TCPAddr)
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		message := []byte{PROTOCOL_VERSION, 0x01, byte(NO_AUTH)}
+		message = append(message, PROTOCOL_VERSION, CMD_CONNECT, 0x00, ATYP_IPV4)
+		message = append(message, addr.IP.To4()...)
+		message = append(message, intToByte(addr.Port)...)
+		conn.Write(message)
+		if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	first := connect()
+	defer first.Close()
+	second := connect()
+	defer second.Close()
+
+	sessions := server.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions() got = %v, want 2", len(sessions))
+	}
+	if sessions[0].Started.After(sessions[1].Started) {
+		t.Errorf("Sessions() are not ordered by start")
+	}
+	for _, session := range sessions {
+		if session.Request == nil || session.Request.Port != addr.Port || session.Request.Command != CMD_CONNECT {
+			t.Errorf("session request got = %+v", session.Request)
+		}
+	}
+
+	if server.CloseSession("missing") {
+		t.Error("CloseSession() of unknown id got = true")
+	}
+	if !server.CloseSession(sessions[0].ID) {
+		t.Error("CloseSession() got = false")
+	}
+	if _, err := io.ReadFull(first, make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after CloseSession() error = %v, want %v", err, io.EOF)
+	}
+
+	got := server.CloseSessions(func(session Session) bool {
+		return session.ID != sessions[0].ID
+	})
+	if got != 1 {
+		t.Errorf("CloseSessions() got = %v, want 1", got)
+	}
+	if _, err := io.ReadFull(second, make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after CloseSessions() error = %v, want %v", err, io.EOF)
+	}
+}
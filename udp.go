@@ -0,0 +1,317 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP request header positions
+const (
+	UDP_ARG_RSV  = 0
+	UDP_ARG_FRAG = 2
+	UDP_ARG_ATYP = 3
+)
+
+const MAX_UDP_DATAGRAM = 65535
+
+type udpDatagram struct {
+	frag byte
+	host string
+	port int
+	data []byte
+}
+
+// udpRelay forwards datagrams of one UDP ASSOCIATE request.
+// Client side datagrams arrive on relay, carry the RFC 1928 header and are
+// sent to their destination from outbound; replies are wrapped back.
+type udpRelay struct {
+	ctrl     net.Conn
+	relay    *net.UDPConn
+	outbound *net.UDPConn
+	log      *zap.Logger
+	// idleTimeout ends the association when no datagram is relayed
+	// in either direction, zero means no limit
+	idleTimeout time.Duration
+	// lastActivity is unix nano time of the last relayed datagram
+	lastActivity int64
+	// allow reports whether datagrams may be sent to the destination,
+	// domain is empty if the client sent an IP address
+	allow func(domain string, dst *net.UDPAddr) bool
+	// count is called with payload bytes of relayed datagrams
+	// of the direction, it may be nil
+	count func(direction string, n int64)
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+// newUDPRelay binds the relay socket on the address the client reached us on.
+// declared is DST.ADDR/DST.PORT of the request: the address the client
+// expects to send datagrams from. Zero fields mean "unknown", in that case
+// the IP of the controlling connection is used and the port is taken from
+// the first datagram.
+func newUDPRelay(ctrl net.Conn, declared *net.UDPAddr, logger *zap.Logger) (*udpRelay, error) {
+	local, ok := ctrl.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("unable to get local address of control connection")
+	}
+	remote, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("unable to get remote address of control connection")
+	}
+
+	client := &net.UDPAddr{IP: remote.IP, Port: declared.Port}
+	if declared.IP != nil && !declared.IP.IsUnspecified() {
+		client.IP = declared.IP
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		relay.Close()
+		return nil, err
+	}
+
+	return &udpRelay{
+		ctrl:     ctrl,
+		relay:    relay,
+		outbound: outbound,
+		log:      logger,
+		client:   client,
+	}, nil
+}
+
+func (r *udpRelay) LocalAddr() *net.UDPAddr {
+	return r.relay.LocalAddr().(*net.UDPAddr)
+}
+
+// Run relays datagrams until the controlling TCP connection is closed,
+// it returns an error if the association is ended by the idle timeout.
+func (r *udpRelay) Run(ctrl io.Reader) error {
+	defer r.Close()
+
+	r.touch()
+	go r.fromClient()
+	go r.fromRemote()
+
+	idle := make(chan struct{})
+	if r.idleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go r.watchIdle(idle, stop)
+	}
+
+	// RFC 1928: a UDP association terminates when the TCP connection
+	// that the UDP ASSOCIATE request arrived on terminates.
+	io.Copy(ioutil.Discard, ctrl)
+	select {
+	case <-idle:
+		return errors.New("idle timeout")
+	default:
+		return nil
+	}
+}
+
+// watchIdle closes idle when no datagram is relayed for idleTimeout
+// and interrupts reading of the controlling connection.
+func (r *udpRelay) watchIdle(idle chan<- struct{}, stop <-chan struct{}) {
+	timer := time.NewTimer(r.idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		if left := r.idleTimeout - r.idle(); left > 0 {
+			timer.Reset(left)
+			continue
+		}
+		close(idle)
+		r.ctrl.SetReadDeadline(time.Now())
+		return
+	}
+}
+
+func (r *udpRelay) touch() {
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+}
+
+// idle returns time since the last relayed datagram.
+func (r *udpRelay) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.lastActivity)))
+}
+
+func (r *udpRelay) Close() {
+	r.closeOnce.Do(func() {
+		r.relay.Close()
+		r.outbound.Close()
+	})
+}
+
+func (r *udpRelay) fromClient() {
+	buf := make([]byte, MAX_UDP_DATAGRAM)
+	for {
+		n, src, err := r.relay.ReadFromUDP(buf)
+		if err != nil {
+			r.Close()
+			return
+		}
+
+		if !r.acceptClient(src) {
+			r.log.Debug(fmt.Sprintf("Dropped UDP datagram from unexpected source %v", src))
+			continue
+		}
+
+		datagram, err := parseUDPDatagram(buf[:n])
+		if err != nil {
+			r.log.Debug(fmt.Sprintf("Dropped UDP datagram from %v: %v", src, err.Error()))
+			continue
+		}
+
+		// Fragmentation is optional, datagrams with non zero FRAG are dropped.
+		if datagram.frag != 0 {
+			continue
+		}
+
+		dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(datagram.host, strconv.Itoa(datagram.port)))
+		if err != nil {
+			r.log.Debug(fmt.Sprintf("Dropped UDP datagram to %s: %v", datagram.host, err.Error()))
+			continue
+		}
+
+		domain := ""
+		if net.ParseIP(datagram.host) == nil {
+			domain = datagram.host
+		}
+		if r.allow != nil && !r.allow(domain, dst) {
+			r.log.Debug(fmt.Sprintf("Dropped UDP datagram to %v: not allowed by ruleset", dst))
+			continue
+		}
+
+		r.touch()
+		if r.count != nil {
+			r.count(DIRECTION_UPLOAD, int64(len(datagram.data)))
+		}
+		_, err = r.outbound.WriteToUDP(datagram.data, dst)
+		if err != nil {
+			r.log.Debug(fmt.Sprintf("UDP write error to %v: %v", dst, err.Error()))
+		}
+	}
+}
+
+func (r *udpRelay) fromRemote() {
+	buf := make([]byte, MAX_UDP_DATAGRAM)
+	for {
+		n, src, err := r.outbound.ReadFromUDP(buf)
+		if err != nil {
+			r.Close()
+			return
+		}
+
+		client := r.clientAddr()
+		if client == nil {
+			continue
+		}
+
+		r.touch()
+		if r.count != nil {
+			r.count(DIRECTION_DOWNLOAD, int64(n))
+		}
+		_, err = r.relay.WriteToUDP(buildUDPDatagram(src, buf[:n]), client)
+		if err != nil {
+			r.log.Debug(fmt.Sprintf("UDP write error to %v: %v", client, err.Error()))
+		}
+	}
+}
+
+// acceptClient reports whether src is the client of the association.
+// If the client did not declare its port, the first datagram fixes it.
+func (r *udpRelay) acceptClient(src *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.client.IP.Equal(src.IP) {
+		return false
+	}
+	if r.client.Port == 0 {
+		r.client.Port = src.Port
+	}
+	return r.client.Port == src.Port
+}
+
+func (r *udpRelay) clientAddr() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client.Port == 0 {
+		return nil
+	}
+	return r.client
+}
+
+func parseUDPDatagram(input []byte) (*udpDatagram, error) {
+	if len(input) < 4 {
+		return nil, errors.New("invalid datagram length")
+	}
+
+	if input[UDP_ARG_RSV] != 0 || input[UDP_ARG_RSV+1] != 0 {
+		return nil, errors.New("invalid reserved field")
+	}
+
+	datagram := &udpDatagram{frag: input[UDP_ARG_FRAG]}
+	var offset int
+	switch input[UDP_ARG_ATYP] {
+	case ATYP_IPV4:
+		offset = 4 + net.IPv4len
+		if len(input) < offset+2 {
+			return nil, errors.New("invalid address")
+		}
+		datagram.host = net.IP(input[4:offset]).String()
+	case ATYP_IPV6:
+		offset = 4 + net.IPv6len
+		if len(input) < offset+2 {
+			return nil, errors.New("invalid address")
+		}
+		datagram.host = net.IP(input[4:offset]).String()
+	case ATYP_DOMAIN:
+		if len(input) < 5 {
+			return nil, errors.New("invalid domain")
+		}
+		offset = 5 + int(input[4])
+		if len(input) < offset+2 {
+			return nil, errors.New("invalid domain")
+		}
+		datagram.host = string(input[5:offset])
+	default:
+		return nil, errors.New("invalid address type")
+	}
+
+	datagram.port = int(binary.BigEndian.Uint16(input[offset : offset+2]))
+	datagram.data = input[offset+2:]
+	return datagram, nil
+}
+
+func buildUDPDatagram(src *net.UDPAddr, data []byte) []byte {
+	atyp, addr := addrBytes(src.IP)
+	r := []byte{0x00, 0x00, 0x00, atyp}
+	r = append(r, addr...)
+	r = append(r, intToByte(src.Port)...)
+	r = append(r, data...)
+	return r
+}
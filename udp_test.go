@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"bytes"
+	"go.uber.org/zap"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_parseUDPDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    *udpDatagram
+		wantErr bool
+	}{
+		{"valid IPv4",
+			[]byte{0x00, 0x00, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35, 0xAA, 0xBB},
+			&udpDatagram{frag: 0, host: "127.0.0.1", port: 53, data: []byte{0xAA, 0xBB}},
+			false},
+		{"valid IPv6",
+			[]byte{0x00, 0x00, 0x00, ATYP_IPV6,
+				0x4f, 0xfe, 0x29, 0x00, 0x55, 0x45, 0x32, 0x10, 0x20, 0x00, 0xf8, 0xff, 0xfe, 0x21, 0x67, 0xcf,
+				0x09, 0x10, 0xAA},
+			&udpDatagram{frag: 0, host: "4ffe:2900:5545:3210:2000:f8ff:fe21:67cf", port: 2320, data: []byte{0xAA}},
+			false},
+		{"valid domain",
+			[]byte{0x00, 0x00, 0x01, ATYP_DOMAIN, 0x0a, 0x72, 0x65, 0x64, 0x68, 0x61, 0x74, 0x2e, 0x63, 0x6f, 0x6d, 0x00, 0x35},
+			&udpDatagram{frag: 1, host: "redhat.com", port: 53, data: []byte{}},
+			false},
+		{"invalid reserved",
+			[]byte{0x00, 0x01, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35},
+			nil,
+			true},
+		{"invalid address type",
+			[]byte{0x00, 0x00, 0x00, 0x10, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35},
+			nil,
+			true},
+		{"short IPv4",
+			[]byte{0x00, 0x00, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01, 0x00},
+			nil,
+			true},
+		{"short domain",
+			[]byte{0x00, 0x00, 0x00, ATYP_DOMAIN, 0x0a, 0x72, 0x65},
+			nil,
+			true},
+		{"empty", []byte{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUDPDatagram(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseUDPDatagram() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUDPDatagram() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildUDPDatagram(t *testing.T) {
+	tests := []struct {
+		name string
+		src  *net.UDPAddr
+		data []byte
+		want []byte
+	}{
+		{"IPv4",
+			&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+			[]byte{0xAA},
+			[]byte{0x00, 0x00, 0x00, ATYP_IPV4, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35, 0xAA}},
+		{"IPv6",
+			&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53},
+			[]byte{0xAA},
+			[]byte{0x00, 0x00, 0x00, ATYP_IPV6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x35, 0xAA}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildUDPDatagram(tt.src, tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("buildUDPDatagram() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_udpRelay(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MAX_UDP_DATAGRAM)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctrlClient, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrlServer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrlServer.Close()
+
+	relay, err := newUDPRelay(ctrlServer, &net.UDPAddr{IP: net.IPv4zero, Port: 0}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploaded, downloaded int64
+	relay.count = func(direction string, n int64) {
+		if direction == DIRECTION_UPLOAD {
+			atomic.AddInt64(&uploaded, n)
+		} else {
+			atomic.AddInt64(&downloaded, n)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		relay.Run(ctrlServer)
+		close(done)
+	}()
+
+	client, err := net.DialUDP("udp", nil, relay.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	payload := []byte("ping")
+	if _, err := client.Write(buildUDPDatagram(echoAddr, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, MAX_UDP_DATAGRAM)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := buildUDPDatagram(echoAddr, payload); !bytes.Equal(buf[:n], want) {
+		t.Errorf("relay reply got = %v, want %v", buf[:n], want)
+	}
+	if up, down := atomic.LoadInt64(&uploaded), atomic.LoadInt64(&downloaded); up != 4 || down != 4 {
+		t.Errorf("counted got = %d, %d, want 4, 4", up, down)
+	}
+
+	ctrlClient.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay not closed with control connection")
+	}
+}
+
+func Test_udpRelay_idleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctrlClient, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrlClient.Close()
+	ctrlServer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrlServer.Close()
+
+	relay, err := newUDPRelay(ctrlServer, &net.UDPAddr{IP: net.IPv4zero, Port: 0}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.idleTimeout = 100 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- relay.Run(ctrlServer)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run() error = nil, want idle timeout")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay not closed by idle timeout")
+	}
+	if _, err := relay.relay.WriteToUDP([]byte{0}, relay.LocalAddr()); err == nil {
+		t.Error("relay socket is not closed")
+	}
+}